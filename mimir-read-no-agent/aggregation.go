@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const defaultAggregationInterval = time.Minute
+
+// AggregationRule sums, counts, etc. the series of matching metrics across
+// labels over a window, like vmagent's stream aggregation, so Mimir gets one
+// series per group instead of one per pod
+type AggregationRule struct {
+	// Match is a regex matched against the metric name, anchored like relabeling
+	Match    string         `yaml:"match"`
+	Interval model.Duration `yaml:"interval,omitempty"`
+	// By keeps only the listed labels, Without removes them. The metric name is always kept.
+	By      []string `yaml:"by,omitempty"`
+	Without []string `yaml:"without,omitempty"`
+	// Outputs are sum, count, min, max, avg, increase, rate and quantiles(phi, ...)
+	Outputs []string `yaml:"outputs"`
+	// KeepInput pushes the matched series as well as the aggregates
+	KeepInput bool `yaml:"keep_input,omitempty"`
+
+	re        *regexp.Regexp
+	quantiles []float64
+	// suffix is appended to the metric name of every output, before the output name
+	suffix string
+}
+
+func (r *AggregationRule) validate() error {
+	if r.Match == "" {
+		return fmt.Errorf("match is required")
+	}
+	re, err := regexp.Compile("^(?:" + r.Match + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid match regex %q: %w", r.Match, err)
+	}
+	r.re = re
+
+	if r.Interval == 0 {
+		r.Interval = model.Duration(defaultAggregationInterval)
+	}
+	if r.Interval < 0 {
+		return fmt.Errorf("interval must be positive")
+	}
+
+	if len(r.By) > 0 && len(r.Without) > 0 {
+		return fmt.Errorf("only one of by and without can be set")
+	}
+	if slices.Contains(r.Without, model.MetricNameLabel) {
+		return fmt.Errorf("without must not include %s", model.MetricNameLabel)
+	}
+
+	if len(r.Outputs) == 0 {
+		return fmt.Errorf("outputs is required")
+	}
+	seen := make(map[string]bool)
+	for _, output := range r.Outputs {
+		name := output
+		if strings.HasPrefix(output, "quantiles(") && strings.HasSuffix(output, ")") {
+			name = "quantiles"
+			for _, s := range strings.Split(output[len("quantiles("):len(output)-1], ",") {
+				phi, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+				if err != nil || phi < 0 || phi > 1 {
+					return fmt.Errorf("invalid quantile %q in %s", strings.TrimSpace(s), output)
+				}
+				r.quantiles = append(r.quantiles, phi)
+			}
+		}
+
+		switch name {
+		case "sum", "count", "min", "max", "avg", "increase", "rate", "quantiles":
+		default:
+			return fmt.Errorf("unknown output %q", output)
+		}
+		if seen[name] {
+			return fmt.Errorf("duplicate output %q", name)
+		}
+		seen[name] = true
+	}
+
+	// The quantiles output adds its own quantile label
+	if seen["quantiles"] && slices.Contains(r.By, model.QuantileLabel) {
+		return fmt.Errorf("by must not include %s with the quantiles output", model.QuantileLabel)
+	}
+
+	// Named like vmagent's outputs, e.g. http_requests_total:1m_without_instance_sum
+	r.suffix = ":" + r.Interval.String()
+	if len(r.By) > 0 {
+		r.suffix += "_by_" + strings.Join(r.By, "_")
+	}
+	if len(r.Without) > 0 {
+		r.suffix += "_without_" + strings.Join(r.Without, "_")
+	}
+
+	return nil
+}
+
+// groupLabels returns the labels a series is aggregated by, still sorted
+func (r *AggregationRule) groupLabels(ls []prompb.Label) []prompb.Label {
+	group := make([]prompb.Label, 0, len(ls))
+	for _, l := range ls {
+		switch {
+		case l.Name == model.MetricNameLabel:
+		case len(r.By) > 0 && !slices.Contains(r.By, l.Name):
+			continue
+		case slices.Contains(r.Without, l.Name):
+			continue
+		}
+		group = append(group, l)
+	}
+	return group
+}
+
+// aggregator runs the stream_aggregation rules over the series of every
+// target, writing the aggregates of each window to the remote writer
+type aggregator struct {
+	writer *fanoutWriter
+
+	mu           sync.RWMutex
+	rules        []*AggregationRule
+	aggregations []*aggregation
+}
+
+func newAggregator(writer *fanoutWriter) *aggregator {
+	return &aggregator{writer: writer}
+}
+
+// apply replaces the running rules if they changed. The windows in progress
+// are lost and the outputs of the old rules are marked stale.
+func (a *aggregator) apply(rules []*AggregationRule) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if reflect.DeepEqual(rules, a.rules) {
+		return
+	}
+
+	for _, ag := range a.aggregations {
+		ag.stop()
+	}
+
+	a.rules = rules
+	a.aggregations = nil
+	for _, r := range rules {
+		log.Printf("Aggregating series matching %s every %v into %v\n", r.Match, r.Interval, r.Outputs)
+		a.aggregations = append(a.aggregations, newAggregation(r, a.writer))
+	}
+}
+
+// aggregate adds the float samples of a target's scrape to every rule they
+// match. It returns the series left to push: the ones no rule matched and the
+// ones every matching rule keeps.
+func (a *aggregator) aggregate(series []bridgeSeries, tenant string) []bridgeSeries {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if len(a.aggregations) == 0 {
+		return series
+	}
+
+	now := time.Now()
+	consumed := make([]bool, len(series))
+	for _, ag := range a.aggregations {
+		ag.add(series, tenant, now, consumed)
+	}
+
+	kept := series[:0]
+	for i, s := range series {
+		if !consumed[i] {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// aggregation is the state of one rule: the groups of the current window
+// and, for increase and rate, the last value of every input series
+type aggregation struct {
+	rule     *AggregationRule
+	writer   *fanoutWriter
+	counting bool
+
+	mu       sync.Mutex
+	groups   map[aggregationKey]*aggregationGroup
+	counters map[aggregationKey]*counterState
+
+	// stale is only used by the flushing goroutine, and by stop once it has ended
+	stale  map[string]*staleTracker
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// aggregationKey identifies a group or an input series. Tenants are
+// aggregated separately, by the tenant of the target; tenant_rules are
+// applied to the labels of the outputs.
+type aggregationKey struct {
+	tenant string
+	hash   uint64
+}
+
+type aggregationGroup struct {
+	labels   []prompb.Label
+	metadata prompb.MetricMetadata
+	// values holds the last value of every input series in the window
+	values   map[uint64]float64
+	increase float64
+}
+
+type counterState struct {
+	value    float64
+	lastSeen time.Time
+}
+
+func newAggregation(r *AggregationRule, writer *fanoutWriter) *aggregation {
+	ctx, cancel := context.WithCancel(context.Background())
+	ag := &aggregation{
+		rule:     r,
+		writer:   writer,
+		counting: slices.Contains(r.Outputs, "increase") || slices.Contains(r.Outputs, "rate"),
+		groups:   make(map[aggregationKey]*aggregationGroup),
+		counters: make(map[aggregationKey]*counterState),
+		stale:    make(map[string]*staleTracker),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+
+	go func() {
+		defer close(ag.done)
+		ag.run(ctx)
+	}()
+
+	return ag
+}
+
+// add puts the matching series into their groups, marking them consumed
+// unless the rule keeps its input. NaN samples, including stale markers, and
+// native histograms are not aggregated. Neither are series whose quantile
+// label the group keeps when the rule has a quantiles output, which would
+// give the output the label twice.
+func (ag *aggregation) add(series []bridgeSeries, tenant string, now time.Time, consumed []bool) {
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+
+	for i, s := range series {
+		if len(s.Samples) != 1 || math.IsNaN(s.Samples[0].Value) {
+			continue
+		}
+		if !ag.rule.re.MatchString(labelValue(s.Labels, model.MetricNameLabel)) {
+			continue
+		}
+		labels := ag.rule.groupLabels(s.Labels)
+		if len(ag.rule.quantiles) > 0 && hasLabel(labels, model.QuantileLabel) {
+			continue
+		}
+		if !ag.rule.KeepInput {
+			consumed[i] = true
+		}
+
+		key := aggregationKey{tenant: tenant, hash: toLabels(labels).Hash()}
+		g, ok := ag.groups[key]
+		if !ok {
+			g = &aggregationGroup{labels: labels, metadata: s.Metadata, values: make(map[uint64]float64)}
+			ag.groups[key] = g
+		}
+
+		v := s.Samples[0].Value
+		input := aggregationKey{tenant: tenant, hash: toLabels(s.Labels).Hash()}
+		g.values[input.hash] = v
+
+		if !ag.counting {
+			continue
+		}
+		// The first sample of a counter only sets its baseline, and a value
+		// below the last one means the counter restarted from zero
+		if c, ok := ag.counters[input]; ok {
+			delta := v - c.value
+			if delta < 0 {
+				delta = v
+			}
+			g.increase += delta
+			c.value, c.lastSeen = v, now
+		} else {
+			ag.counters[input] = &counterState{value: v, lastSeen: now}
+		}
+	}
+}
+
+// run flushes a window at every multiple of the interval since the Unix
+// epoch, so bridges running the same rules emit at the same times. The
+// first window starts mid-interval and is discarded, since its increase and
+// rate would be too low.
+func (ag *aggregation) run(ctx context.Context) {
+	interval := time.Duration(ag.rule.Interval)
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(interval - time.Duration(time.Now().UnixNano())%interval):
+	}
+	ag.flush(time.Now(), false)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			ag.flush(now, true)
+		}
+	}
+}
+
+// flush starts a new window and, if write is set, writes the outputs of the
+// one that ended, with stale markers for groups that received no samples.
+// Counters not seen for two intervals are forgotten.
+func (ag *aggregation) flush(now time.Time, write bool) {
+	ag.mu.Lock()
+	groups := ag.groups
+	ag.groups = make(map[aggregationKey]*aggregationGroup)
+	for key, c := range ag.counters {
+		if now.Sub(c.lastSeen) > 2*time.Duration(ag.rule.Interval) {
+			delete(ag.counters, key)
+		}
+	}
+	ag.mu.Unlock()
+
+	if !write {
+		return
+	}
+
+	timestamp := now.UnixMilli()
+	byTenant := make(map[string][]bridgeSeries)
+	for key, g := range groups {
+		byTenant[key.tenant] = append(byTenant[key.tenant], ag.outputs(g, timestamp)...)
+	}
+	for tenant := range ag.stale {
+		if _, ok := byTenant[tenant]; !ok {
+			byTenant[tenant] = nil
+		}
+	}
+
+	for tenant, series := range byTenant {
+		stale, ok := ag.stale[tenant]
+		if !ok {
+			stale = newStaleTracker()
+			ag.stale[tenant] = stale
+		}
+		markers, _ := stale.update(series, timestamp)
+
+		if err := ag.writer.write(append(series, markers...), tenant); err != nil {
+			log.Printf("Error writing aggregates of %s to WAL: %v\n", ag.rule.Match, err)
+		}
+	}
+}
+
+// outputs computes the configured outputs of a group. sum, count, min, max,
+// avg and quantiles are taken over the last value of every input series in
+// the window; increase and rate over every sample.
+func (ag *aggregation) outputs(g *aggregationGroup, timestamp int64) []bridgeSeries {
+	values := make([]float64, 0, len(g.values))
+	for _, v := range g.values {
+		values = append(values, v)
+	}
+	slices.Sort(values)
+
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+
+	// Every output is a gauge: a sum of counters drops when an input goes
+	// away, which rate() would read as a reset
+	base := labelValue(g.labels, model.MetricNameLabel) + ag.rule.suffix
+	var series []bridgeSeries
+	for _, output := range ag.rule.Outputs {
+		var v float64
+		switch output {
+		case "sum":
+			v = sum
+		case "count":
+			v = float64(len(values))
+		case "min":
+			v = values[0]
+		case "max":
+			v = values[len(values)-1]
+		case "avg":
+			v = sum / float64(len(values))
+		case "increase":
+			v = g.increase
+		case "rate":
+			v = g.increase / time.Duration(ag.rule.Interval).Seconds()
+		default:
+			for _, phi := range ag.rule.quantiles {
+				q := prompb.Label{Name: model.QuantileLabel, Value: strconv.FormatFloat(phi, 'f', -1, 64)}
+				series = append(series, ag.output(g, base+"_quantiles", quantile(phi, values), timestamp, q))
+			}
+			continue
+		}
+		series = append(series, ag.output(g, base+"_"+output, v, timestamp))
+	}
+
+	return series
+}
+
+// output builds a gauge series of a group
+func (ag *aggregation) output(g *aggregationGroup, name string, v float64, timestamp int64, extra ...prompb.Label) bridgeSeries {
+	labels := make([]prompb.Label, 0, len(g.labels)+len(extra))
+	for _, l := range g.labels {
+		if l.Name == model.MetricNameLabel {
+			l.Value = name
+		}
+		labels = append(labels, l)
+	}
+	labels = append(labels, extra...)
+	sortLabels(labels)
+
+	metadata := prompb.MetricMetadata{
+		Type:             prompb.MetricMetadata_GAUGE,
+		MetricFamilyName: name,
+		Help:             g.metadata.Help,
+		Unit:             g.metadata.Unit,
+	}
+	return bridgeSeries{
+		TimeSeries: prompb.TimeSeries{
+			Labels:  labels,
+			Samples: []prompb.Sample{{Value: v, Timestamp: timestamp}},
+		},
+		Metadata: metadata,
+	}
+}
+
+// stop ends the rule's goroutine and marks its outputs stale
+func (ag *aggregation) stop() {
+	ag.cancel()
+	<-ag.done
+
+	timestamp := time.Now().UnixMilli()
+	for tenant, stale := range ag.stale {
+		markers := stale.markAll(timestamp)
+		if len(markers) == 0 {
+			continue
+		}
+		if err := ag.writer.write(markers, tenant); err != nil {
+			log.Printf("Error writing aggregates of %s to WAL: %v\n", ag.rule.Match, err)
+		}
+	}
+}
+
+// quantile interpolates the phi-quantile of sorted values like PromQL's quantile()
+func quantile(phi float64, values []float64) float64 {
+	rank := phi * float64(len(values)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	weight := rank - float64(lower)
+	return values[lower]*(1-weight) + values[upper]*weight
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func aggregationInput(name string, value float64, extra ...string) bridgeSeries {
+	s := testSeries(name, 0, value)
+	for i := 0; i < len(extra); i += 2 {
+		s.Labels = append(s.Labels, prompb.Label{Name: extra[i], Value: extra[i+1]})
+	}
+	sortLabels(s.Labels)
+	return s
+}
+
+// newTestAggregation returns the state of a validated rule without the
+// goroutine flushing it, so tests flush by hand
+func newTestAggregation(t *testing.T, r AggregationRule, writer *fanoutWriter) *aggregation {
+	if err := r.validate(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	close(done)
+	return &aggregation{
+		rule:     &r,
+		writer:   writer,
+		counting: true,
+		groups:   make(map[aggregationKey]*aggregationGroup),
+		counters: make(map[aggregationKey]*counterState),
+		stale:    make(map[string]*staleTracker),
+		cancel:   func() {},
+		done:     done,
+	}
+}
+
+func TestAggregationRuleValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		rule AggregationRule
+		err  string
+	}{
+		{"no match", AggregationRule{Outputs: []string{"sum"}}, "match is required"},
+		{"bad regex", AggregationRule{Match: "(", Outputs: []string{"sum"}}, "invalid match regex"},
+		{"no outputs", AggregationRule{Match: "a"}, "outputs is required"},
+		{"unknown output", AggregationRule{Match: "a", Outputs: []string{"median"}}, "unknown output"},
+		{"duplicate output", AggregationRule{Match: "a", Outputs: []string{"sum", "sum"}}, "duplicate output"},
+		{"bad quantile", AggregationRule{Match: "a", Outputs: []string{"quantiles(0.5, 2)"}}, "invalid quantile"},
+		{"by and without", AggregationRule{Match: "a", Outputs: []string{"sum"}, By: []string{"a"}, Without: []string{"b"}}, "only one of by and without"},
+		{"without name", AggregationRule{Match: "a", Outputs: []string{"sum"}, Without: []string{"__name__"}}, "without must not include"},
+		{"by quantile", AggregationRule{Match: "a", Outputs: []string{"quantiles(0.5)"}, By: []string{"quantile"}}, "by must not include quantile"},
+		{"negative interval", AggregationRule{Match: "a", Outputs: []string{"sum"}, Interval: model.Duration(-time.Second)}, "interval must be positive"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.rule.validate()
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("got %v, want an error containing %q", err, tc.err)
+			}
+		})
+	}
+
+	r := AggregationRule{Match: "a", Outputs: []string{"sum"}, Without: []string{"instance", "pod"}}
+	if err := r.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if r.suffix != ":1m_without_instance_pod" {
+		t.Errorf("got suffix %q", r.suffix)
+	}
+}
+
+func TestAggregationOutputs(t *testing.T) {
+	ag := newTestAggregation(t, AggregationRule{
+		Match:    "requests_total",
+		Interval: model.Duration(10 * time.Second),
+		Without:  []string{"instance"},
+		Outputs:  []string{"sum", "count", "min", "max", "avg", "increase", "rate", "quantiles(0, 0.5, 1)"},
+	}, nil)
+
+	now := time.Now()
+	scrape := func(a, b float64) {
+		series := []bridgeSeries{
+			aggregationInput("requests_total", a, "instance", "a", "job", "web"),
+			aggregationInput("requests_total", b, "instance", "b", "job", "web"),
+			aggregationInput("other_total", 1, "instance", "a"),
+		}
+		consumed := make([]bool, len(series))
+		ag.add(series, "", now, consumed)
+		if !consumed[0] || !consumed[1] || consumed[2] {
+			t.Errorf("got consumed %v, want the matching series only", consumed)
+		}
+	}
+	// b restarts from 0 between the scrapes: increase is 3 from a and 2 from b
+	scrape(1, 3)
+	scrape(4, 2)
+
+	if len(ag.groups) != 1 {
+		t.Fatalf("got %d groups, want 1", len(ag.groups))
+	}
+	var g *aggregationGroup
+	for _, g = range ag.groups {
+	}
+
+	want := map[string]float64{
+		"requests_total:10s_without_instance_sum":       6,
+		"requests_total:10s_without_instance_count":     2,
+		"requests_total:10s_without_instance_min":       2,
+		"requests_total:10s_without_instance_max":       4,
+		"requests_total:10s_without_instance_avg":       3,
+		"requests_total:10s_without_instance_increase":  5,
+		"requests_total:10s_without_instance_rate":      0.5,
+		"requests_total:10s_without_instance_quantiles": 0,
+	}
+	quantiles := map[string]float64{"0": 2, "0.5": 3, "1": 4}
+
+	outputs := ag.outputs(g, 1000)
+	if len(outputs) != len(want)+len(quantiles)-1 {
+		t.Fatalf("got %d outputs, want %d", len(outputs), len(want)+len(quantiles)-1)
+	}
+	for _, s := range outputs {
+		name := labelValue(s.Labels, model.MetricNameLabel)
+		wantValue, ok := want[name]
+		if q := labelValue(s.Labels, model.QuantileLabel); q != "" {
+			wantValue, ok = quantiles[q]
+		}
+		if !ok {
+			t.Errorf("unexpected output %v", s.Labels)
+			continue
+		}
+		if s.Samples[0].Value != wantValue || s.Samples[0].Timestamp != 1000 {
+			t.Errorf("%v: got %v, want %v at 1000", s.Labels, s.Samples[0], wantValue)
+		}
+		if labelValue(s.Labels, "job") != "web" || labelValue(s.Labels, "instance") != "" {
+			t.Errorf("%v: want job kept and instance dropped", s.Labels)
+		}
+		if s.Metadata.Type != prompb.MetricMetadata_GAUGE || s.Metadata.MetricFamilyName != name {
+			t.Errorf("%v: got metadata %+v, want a gauge named after the output", s.Labels, s.Metadata)
+		}
+	}
+}
+
+func TestAggregationQuantileInputs(t *testing.T) {
+	summary := []bridgeSeries{aggregationInput("rpc_seconds", 1, "instance", "a", "quantile", "0.5")}
+
+	ag := newTestAggregation(t, AggregationRule{Match: "rpc_seconds", Without: []string{"instance"}, Outputs: []string{"quantiles(0.9)"}}, nil)
+	consumed := make([]bool, 1)
+	ag.add(summary, "", time.Now(), consumed)
+	if consumed[0] || len(ag.groups) != 0 {
+		t.Errorf("summary quantile series was aggregated into quantiles")
+	}
+
+	ag = newTestAggregation(t, AggregationRule{Match: "rpc_seconds", Without: []string{"instance", "quantile"}, Outputs: []string{"quantiles(0.9)"}}, nil)
+	ag.add(summary, "", time.Now(), consumed)
+	if !consumed[0] || len(ag.groups) != 1 {
+		t.Errorf("summary quantile series was not aggregated with its quantile label dropped")
+	}
+}
+
+func TestAggregationCounterExpiry(t *testing.T) {
+	interval := 10 * time.Second
+	ag := newTestAggregation(t, AggregationRule{Match: "requests_total", Interval: model.Duration(interval), Outputs: []string{"increase"}}, nil)
+
+	start := time.Now()
+	ag.add([]bridgeSeries{aggregationInput("requests_total", 5)}, "", start, make([]bool, 1))
+	ag.flush(start.Add(interval), false)
+	if len(ag.counters) != 1 {
+		t.Fatalf("got %d counters, want 1", len(ag.counters))
+	}
+
+	// A counter not seen for two intervals starts from a new baseline
+	ag.flush(start.Add(3*interval), false)
+	if len(ag.counters) != 0 {
+		t.Fatalf("got %d counters after two idle intervals, want 0", len(ag.counters))
+	}
+	ag.add([]bridgeSeries{aggregationInput("requests_total", 8)}, "", start.Add(3*interval), make([]bool, 1))
+	for _, g := range ag.groups {
+		if g.increase != 0 {
+			t.Errorf("got increase %v from an expired counter, want 0", g.increase)
+		}
+	}
+}
+
+func TestAggregationFlush(t *testing.T) {
+	recv := newTestReceiver(t)
+	rw := testRemoteWriteConfig(recv.URL)
+	writer := newTestWriter(t, &rw)
+
+	interval := 10 * time.Second
+	ag := newTestAggregation(t, AggregationRule{
+		Match:    "requests_total",
+		Interval: model.Duration(interval),
+		Without:  []string{"instance"},
+		Outputs:  []string{"sum"},
+	}, writer)
+
+	start := time.UnixMilli(1_000_000)
+	ag.add([]bridgeSeries{aggregationInput("requests_total", 1, "instance", "a", "team", "x")}, "tenant-a", start, make([]bool, 1))
+
+	// The first window is discarded
+	ag.flush(start.Add(interval), false)
+
+	ag.add([]bridgeSeries{
+		aggregationInput("requests_total", 2, "instance", "a", "team", "x"),
+		aggregationInput("requests_total", 3, "instance", "b", "team", "x"),
+		aggregationInput("requests_total", 4, "instance", "a", "team", "y"),
+	}, "tenant-a", start.Add(interval), make([]bool, 3))
+	ag.flush(start.Add(2*interval), true)
+
+	// Group y received nothing in this window and is marked stale
+	ag.add([]bridgeSeries{aggregationInput("requests_total", 5, "instance", "a", "team", "x")}, "tenant-a", start.Add(2*interval), make([]bool, 1))
+	ag.flush(start.Add(3*interval), true)
+
+	// Stopping marks the remaining output stale
+	ag.stop()
+	drainWriter(t, writer)
+
+	type point struct {
+		team      string
+		value     string
+		timestamp int64
+	}
+	var got []point
+	for _, s := range recv.received() {
+		if s.tenant != "tenant-a" {
+			t.Errorf("got tenant %q, want tenant-a", s.tenant)
+		}
+		if name := labelValue(s.Labels, model.MetricNameLabel); name != "requests_total:10s_without_instance_sum" {
+			t.Errorf("got output %q", name)
+		}
+		p := point{labelValue(s.Labels, "team"), strconv.FormatFloat(s.Samples[0].Value, 'f', -1, 64), s.Samples[0].Timestamp}
+		if value.IsStaleNaN(s.Samples[0].Value) {
+			p.value = "stale"
+		}
+		// The markers written by stop are stamped with the current time
+		if p.timestamp > start.Add(3*interval).UnixMilli() {
+			p.timestamp = 0
+		}
+		got = append(got, p)
+	}
+
+	want := map[point]bool{
+		{"x", "5", start.Add(2 * interval).UnixMilli()}:     true,
+		{"y", "4", start.Add(2 * interval).UnixMilli()}:     true,
+		{"x", "5", start.Add(3 * interval).UnixMilli()}:     true,
+		{"y", "stale", start.Add(3 * interval).UnixMilli()}: true,
+		{"x", "stale", 0}: true,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %d samples", got, len(want))
+	}
+	for _, p := range got {
+		if !want[p] {
+			t.Errorf("unexpected sample %+v", p)
+		}
+	}
+}
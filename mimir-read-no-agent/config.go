@@ -0,0 +1,581 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	config_util "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/prompb"
+	"go.yaml.in/yaml/v2"
+)
+
+const (
+	defaultRemoteWriteURL = "http://localhost:9009/api/v1/push"
+	defaultMetricsURL     = "http://localhost:8080/metrics"
+	defaultJob            = "prom-metrics-demo-server"
+	defaultScrapeInterval = 5 * time.Second
+	defaultScrapeTimeout  = 10 * time.Second
+)
+
+// Config is the bridge configuration loaded from a YAML file
+type Config struct {
+	RemoteWrite remoteWriteConfigs `yaml:"remote_write"`
+	WAL         WALConfig          `yaml:"wal"`
+	Targets     []*TargetConfig    `yaml:"targets"`
+	// StreamAggregation rules aggregate the series of all targets before they are pushed
+	StreamAggregation []*AggregationRule `yaml:"stream_aggregation,omitempty"`
+}
+
+// remoteWriteConfigs is a list of remote_write endpoints. A single endpoint
+// can also be given without the list, as configs from before fan-out do, and
+// then still defaults to the local Mimir when it has no url.
+type remoteWriteConfigs []*RemoteWriteConfig
+
+func (c *remoteWriteConfigs) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	if _, ok := raw.([]interface{}); ok {
+		var list []*RemoteWriteConfig
+		if err := unmarshal(&list); err != nil {
+			return err
+		}
+		*c = list
+		return nil
+	}
+
+	var single RemoteWriteConfig
+	if err := unmarshal(&single); err != nil {
+		return err
+	}
+	if single.URL == "" {
+		single.URL = defaultRemoteWriteURL
+	}
+	*c = remoteWriteConfigs{&single}
+	return nil
+}
+
+// RemoteWriteConfig describes where and how scraped series are pushed
+type RemoteWriteConfig struct {
+	// Name tells endpoints apart and names the WAL directory of every
+	// endpoint after the first
+	Name          string         `yaml:"name,omitempty"`
+	URL           string         `yaml:"url"`
+	RemoteTimeout model.Duration `yaml:"remote_timeout,omitempty"`
+	// ProtobufMessage selects remote write 1.0 (prometheus.WriteRequest) or
+	// 2.0 (io.prometheus.write.v2.Request)
+	ProtobufMessage string      `yaml:"protobuf_message,omitempty"`
+	QueueConfig     QueueConfig `yaml:"queue_config,omitempty"`
+	// MetadataConfig controls sending HELP, TYPE and UNIT of scraped metrics
+	MetadataConfig MetadataConfig `yaml:"metadata_config,omitempty"`
+
+	// Tenant is sent as X-Scope-OrgID for series no target or rule assigns a tenant to
+	Tenant      string        `yaml:"tenant,omitempty"`
+	TenantRules []*TenantRule `yaml:"tenant_rules,omitempty"`
+
+	// WriteRelabelConfigs rewrite or drop series sent to this endpoint only
+	WriteRelabelConfigs []*relabel.Config `yaml:"write_relabel_configs,omitempty"`
+
+	// Basic auth, bearer token, custom headers and mTLS, same fields as Prometheus
+	HTTPClientConfig config_util.HTTPClientConfig `yaml:",inline"`
+}
+
+func (r *RemoteWriteConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*r = defaultRemoteWriteConfig()
+	type plain RemoteWriteConfig
+	return unmarshal((*plain)(r))
+}
+
+// QueueConfig tunes batching, sharding and retries, modeled on Alloy's queue_config
+type QueueConfig struct {
+	// Capacity is the number of samples buffered per shard
+	Capacity          int            `yaml:"capacity,omitempty"`
+	MinShards         int            `yaml:"min_shards,omitempty"`
+	MaxShards         int            `yaml:"max_shards,omitempty"`
+	MaxSamplesPerSend int            `yaml:"max_samples_per_send,omitempty"`
+	BatchSendDeadline model.Duration `yaml:"batch_send_deadline,omitempty"`
+	MinBackoff        model.Duration `yaml:"min_backoff,omitempty"`
+	MaxBackoff        model.Duration `yaml:"max_backoff,omitempty"`
+	RetryOnRateLimit  bool           `yaml:"retry_on_http_429"`
+}
+
+// MetadataConfig is Prometheus' metadata_config. Remote write 2.0 sends
+// metadata with every series; for 1.0 the metadata seen since the last send
+// goes out in a separate request every send_interval.
+type MetadataConfig struct {
+	Send              bool           `yaml:"send"`
+	SendInterval      model.Duration `yaml:"send_interval,omitempty"`
+	MaxSamplesPerSend int            `yaml:"max_samples_per_send,omitempty"`
+}
+
+// WALConfig controls the on-disk write-ahead log that holds pushes until Mimir accepts them
+type WALConfig struct {
+	Directory string `yaml:"directory"`
+	// MaxAge drops records Mimir would reject as too old anyway
+	MaxAge model.Duration `yaml:"max_age,omitempty"`
+}
+
+// defaultConfig returns the settings used for anything the config file leaves out
+func defaultConfig() *Config {
+	rw := defaultRemoteWriteConfig()
+	rw.URL = defaultRemoteWriteURL
+	return &Config{
+		RemoteWrite: remoteWriteConfigs{&rw},
+		WAL: WALConfig{
+			Directory: "data/wal",
+			MaxAge:    model.Duration(8 * time.Hour),
+		},
+	}
+}
+
+// defaultRemoteWriteConfig returns the settings of a remote_write endpoint
+// for anything the config file leaves out, apart from the url
+func defaultRemoteWriteConfig() RemoteWriteConfig {
+	return RemoteWriteConfig{
+		RemoteTimeout:    model.Duration(10 * time.Second),
+		HTTPClientConfig: config_util.DefaultHTTPClientConfig,
+		ProtobufMessage:  remoteWriteProtoMsgV1,
+		QueueConfig: QueueConfig{
+			Capacity:          10000,
+			MinShards:         1,
+			MaxShards:         50,
+			MaxSamplesPerSend: 2000,
+			BatchSendDeadline: model.Duration(5 * time.Second),
+			MinBackoff:        model.Duration(30 * time.Millisecond),
+			MaxBackoff:        model.Duration(5 * time.Second),
+			RetryOnRateLimit:  true,
+		},
+		MetadataConfig: MetadataConfig{
+			Send:              true,
+			SendInterval:      model.Duration(time.Minute),
+			MaxSamplesPerSend: 2000,
+		},
+	}
+}
+
+// TargetConfig describes a single endpoint to scrape and the labels attached
+// to its series. With service discovery configs instead of a url it is a
+// template for every target discovered, like a Prometheus scrape_config.
+type TargetConfig struct {
+	URL      string            `yaml:"url,omitempty"`
+	Job      string            `yaml:"job"`
+	Instance string            `yaml:"instance,omitempty"`
+	Interval model.Duration    `yaml:"interval,omitempty"`
+	Timeout  model.Duration    `yaml:"timeout,omitempty"`
+	Labels   map[string]string `yaml:"labels,omitempty"`
+	Tenant   string            `yaml:"tenant,omitempty"`
+
+	// HonorTimestamps keeps timestamps exposed by the target instead of using the scrape time
+	HonorTimestamps *bool `yaml:"honor_timestamps,omitempty"`
+	// ScrapeProtocols lists the exposition formats to ask for, most preferred first
+	ScrapeProtocols []string `yaml:"scrape_protocols,omitempty"`
+	// AlwaysScrapeClassicHistograms also sends the classic buckets of
+	// histograms that expose native buckets
+	AlwaysScrapeClassicHistograms bool `yaml:"always_scrape_classic_histograms,omitempty"`
+
+	// Limits fail a scrape, reporting up 0, instead of flooding Mimir when a
+	// target suddenly exposes far more than usual. 0 means no limit. The
+	// sample and label limits apply after metric_relabel_configs.
+	BodySizeLimit         byteSize `yaml:"body_size_limit,omitempty"`
+	SampleLimit           int      `yaml:"sample_limit,omitempty"`
+	LabelLimit            int      `yaml:"label_limit,omitempty"`
+	LabelNameLengthLimit  int      `yaml:"label_name_length_limit,omitempty"`
+	LabelValueLengthLimit int      `yaml:"label_value_length_limit,omitempty"`
+
+	// ExemplarLimit caps the exemplars forwarded per scrape; the rest are
+	// dropped without failing the scrape. 0 means no limit.
+	ExemplarLimit int `yaml:"exemplar_limit,omitempty"`
+
+	// MetricNameValidationScheme is legacy (the default, what Mimir accepts
+	// unless configured otherwise) or utf8. Series with names invalid under
+	// it are dropped.
+	MetricNameValidationScheme model.ValidationScheme `yaml:"metric_name_validation_scheme,omitempty"`
+
+	// RelabelConfigs rewrite the target's labels, including __address__,
+	// __scheme__ and __metrics_path__, before it is scraped
+	RelabelConfigs []*relabel.Config `yaml:"relabel_configs,omitempty"`
+	// MetricRelabelConfigs rewrite or drop scraped series before they are pushed
+	MetricRelabelConfigs []*relabel.Config `yaml:"metric_relabel_configs,omitempty"`
+	// TemporalityConversions turn delta counters into cumulative ones or the
+	// reverse, after metric_relabel_configs
+	TemporalityConversions []*TemporalityRule `yaml:"temporality_conversions,omitempty"`
+
+	// KubernetesSDConfigs discover the targets from the Kubernetes API server
+	KubernetesSDConfigs []*KubernetesSDConfig `yaml:"kubernetes_sd_configs,omitempty"`
+	// FileSDConfigs read the targets from JSON or YAML target group files
+	FileSDConfigs []*FileSDConfig `yaml:"file_sd_configs,omitempty"`
+	// HTTPSDConfigs fetch the targets from an HTTP endpoint
+	HTTPSDConfigs []*HTTPSDConfig `yaml:"http_sd_configs,omitempty"`
+
+	// Resolved by validate from the fields above
+	scrapeURL    string
+	acceptHeader string
+	labels       []prompb.Label
+	dropped      bool
+}
+
+// configOverrides hold settings given as flags or environment variables,
+// which take precedence over the config file
+type configOverrides struct {
+	remoteWriteURL string
+	walDirectory   string
+}
+
+func (o configOverrides) apply(cfg *Config) {
+	if o.remoteWriteURL != "" && len(cfg.RemoteWrite) > 0 {
+		cfg.RemoteWrite[0].URL = o.remoteWriteURL
+	}
+	if o.walDirectory != "" {
+		cfg.WAL.Directory = o.walDirectory
+	}
+}
+
+// loadConfig reads the config file at path and applies the overrides. An
+// empty path yields a single target pointing at the local demo server so the
+// bridge still runs out of the box.
+func loadConfig(path string, overrides configOverrides) (*Config, error) {
+	if path == "" {
+		cfg := defaultConfig()
+		cfg.Targets = []*TargetConfig{{URL: defaultMetricsURL, Job: defaultJob}}
+		overrides.apply(cfg)
+		return cfg, cfg.validate()
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	cfg := defaultConfig()
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+
+	// Credential and certificate files are relative to the config file
+	for _, rw := range cfg.RemoteWrite {
+		rw.HTTPClientConfig.SetDirectory(filepath.Dir(path))
+	}
+	for _, t := range cfg.Targets {
+		for _, sd := range t.KubernetesSDConfigs {
+			sd.HTTPClientConfig.SetDirectory(filepath.Dir(path))
+		}
+		for _, sd := range t.FileSDConfigs {
+			sd.setDirectory(filepath.Dir(path))
+		}
+		for _, sd := range t.HTTPSDConfigs {
+			sd.HTTPClientConfig.SetDirectory(filepath.Dir(path))
+		}
+	}
+	overrides.apply(cfg)
+
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// validate checks the config and fills in per-target defaults
+func (c *Config) validate() error {
+	if len(c.RemoteWrite) == 0 {
+		return fmt.Errorf("remote_write: no endpoints configured")
+	}
+	names := make(map[string]bool)
+	for i, rw := range c.RemoteWrite {
+		if err := rw.validate(); err != nil {
+			return fmt.Errorf("remote_write %d: %w", i, err)
+		}
+
+		// Endpoints after the first get a WAL directory named after them
+		if i == 0 {
+			continue
+		}
+		if rw.Name == "" {
+			return fmt.Errorf("remote_write %d: name is required for every endpoint after the first", i)
+		}
+		if names[rw.Name] {
+			return fmt.Errorf("remote_write %d: duplicate name %q", i, rw.Name)
+		}
+		names[rw.Name] = true
+	}
+
+	if c.WAL.Directory == "" {
+		return fmt.Errorf("wal: directory is required")
+	}
+
+	if len(c.Targets) == 0 {
+		return fmt.Errorf("no targets configured")
+	}
+
+	seen := make(map[string]bool)
+	jobs := make(map[string]bool)
+	targets := c.Targets[:0]
+	for i, t := range c.Targets {
+		if err := t.validate(); err != nil {
+			return fmt.Errorf("target %d: %w", i, err)
+		}
+
+		// Discovered targets are told apart by the job of their template
+		if t.hasDiscovery() {
+			if jobs[t.Job] {
+				return fmt.Errorf("target %d: duplicate job %q for service discovery", i, t.Job)
+			}
+			jobs[t.Job] = true
+			targets = append(targets, t)
+			continue
+		}
+
+		// Targets dropped by relabel_configs are simply not scraped
+		if t.dropped {
+			continue
+		}
+		targets = append(targets, t)
+
+		key := t.Job + "/" + t.Instance
+		if seen[key] {
+			return fmt.Errorf("target %d: duplicate job %q and instance %q", i, t.Job, t.Instance)
+		}
+		seen[key] = true
+	}
+
+	c.Targets = targets
+	if len(c.Targets) == 0 {
+		return fmt.Errorf("all targets were dropped by relabel_configs")
+	}
+
+	for i, rule := range c.StreamAggregation {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("stream_aggregation %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *RemoteWriteConfig) validate() error {
+	if r.Name != "" && (r.Name == "." || r.Name == ".." || strings.ContainsAny(r.Name, `/\`)) {
+		return fmt.Errorf("name %q is not a valid directory name", r.Name)
+	}
+
+	if r.URL == "" {
+		return fmt.Errorf("url is required")
+	}
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url %q: %w", r.URL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid url %q: scheme must be http or https", r.URL)
+	}
+
+	if r.RemoteTimeout <= 0 {
+		return fmt.Errorf("remote_timeout must be positive")
+	}
+
+	if err := r.HTTPClientConfig.Validate(); err != nil {
+		return err
+	}
+
+	if r.ProtobufMessage != remoteWriteProtoMsgV1 && r.ProtobufMessage != remoteWriteProtoMsgV2 {
+		return fmt.Errorf("protobuf_message must be %q or %q", remoteWriteProtoMsgV1, remoteWriteProtoMsgV2)
+	}
+
+	if r.Tenant != "" {
+		if err := validateTenantID(r.Tenant); err != nil {
+			return err
+		}
+	}
+	for i, rule := range r.TenantRules {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("tenant_rules %d: %w", i, err)
+		}
+	}
+
+	q := r.QueueConfig
+	if q.Capacity <= 0 {
+		return fmt.Errorf("queue_config: capacity must be positive")
+	}
+	if q.MinShards <= 0 || q.MaxShards < q.MinShards {
+		return fmt.Errorf("queue_config: min_shards must be positive and not greater than max_shards")
+	}
+	if q.MaxSamplesPerSend <= 0 {
+		return fmt.Errorf("queue_config: max_samples_per_send must be positive")
+	}
+	if q.BatchSendDeadline <= 0 {
+		return fmt.Errorf("queue_config: batch_send_deadline must be positive")
+	}
+	if q.MinBackoff <= 0 || q.MaxBackoff < q.MinBackoff {
+		return fmt.Errorf("queue_config: min_backoff must be positive and not greater than max_backoff")
+	}
+
+	m := r.MetadataConfig
+	if m.SendInterval <= 0 {
+		return fmt.Errorf("metadata_config: send_interval must be positive")
+	}
+	if m.MaxSamplesPerSend <= 0 {
+		return fmt.Errorf("metadata_config: max_samples_per_send must be positive")
+	}
+
+	return nil
+}
+
+func (t *TargetConfig) validate() error {
+	var u *url.URL
+	desc := t.URL
+	switch {
+	case t.hasDiscovery():
+		if t.URL != "" || t.Instance != "" {
+			return fmt.Errorf("url and instance cannot be set together with service discovery for job %q", t.Job)
+		}
+		if t.Job == "" {
+			return fmt.Errorf("job is required")
+		}
+		desc = fmt.Sprintf("job %q", t.Job)
+
+	case t.URL == "":
+		return fmt.Errorf("url or a service discovery config is required")
+
+	default:
+		var err error
+		u, err = url.Parse(t.URL)
+		if err != nil {
+			return fmt.Errorf("invalid url %q: %w", t.URL, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("invalid url %q: scheme must be http or https", t.URL)
+		}
+		if t.Job == "" {
+			return fmt.Errorf("job is required for %s", t.URL)
+		}
+	}
+
+	if t.Interval == 0 {
+		t.Interval = model.Duration(defaultScrapeInterval)
+	}
+
+	if t.Timeout == 0 {
+		t.Timeout = model.Duration(defaultScrapeTimeout)
+		if t.Timeout > t.Interval {
+			t.Timeout = t.Interval
+		}
+	}
+	if t.Timeout > t.Interval {
+		return fmt.Errorf("timeout %s is greater than interval %s for %s", t.Timeout, t.Interval, desc)
+	}
+
+	if t.Tenant != "" {
+		if err := validateTenantID(t.Tenant); err != nil {
+			return fmt.Errorf("%w for %s", err, desc)
+		}
+	}
+
+	if t.SampleLimit < 0 || t.LabelLimit < 0 || t.LabelNameLengthLimit < 0 || t.LabelValueLengthLimit < 0 || t.ExemplarLimit < 0 {
+		return fmt.Errorf("limits must not be negative for %s", desc)
+	}
+
+	for i, rule := range t.TemporalityConversions {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("temporality_conversions %d for %s: %w", i, desc, err)
+		}
+	}
+
+	if t.MetricNameValidationScheme == model.UnsetValidation {
+		t.MetricNameValidationScheme = model.LegacyValidation
+	}
+
+	if t.HonorTimestamps == nil {
+		honor := true
+		t.HonorTimestamps = &honor
+	}
+
+	if len(t.ScrapeProtocols) == 0 {
+		t.ScrapeProtocols = defaultScrapeProtocols
+	}
+	seen := make(map[string]bool)
+	for _, p := range t.ScrapeProtocols {
+		if _, ok := scrapeProtocolHeaders[p]; !ok {
+			return fmt.Errorf("unknown scrape protocol %q for %s", p, desc)
+		}
+		if seen[p] {
+			return fmt.Errorf("duplicate scrape protocol %q for %s", p, desc)
+		}
+		seen[p] = true
+	}
+	t.acceptHeader = acceptHeader(t.ScrapeProtocols)
+
+	for name := range t.Labels {
+		if !model.LabelName(name).IsValid() {
+			return fmt.Errorf("invalid label name %q for %s", name, desc)
+		}
+		if name == model.JobLabel || name == model.InstanceLabel {
+			return fmt.Errorf("label %q must be set with the %s field for %s", name, name, desc)
+		}
+	}
+
+	if t.hasDiscovery() {
+		for i, sd := range t.KubernetesSDConfigs {
+			if err := sd.validate(); err != nil {
+				return fmt.Errorf("kubernetes_sd_configs %d for %s: %w", i, desc, err)
+			}
+		}
+		for i, sd := range t.FileSDConfigs {
+			if err := sd.validate(); err != nil {
+				return fmt.Errorf("file_sd_configs %d for %s: %w", i, desc, err)
+			}
+		}
+		for i, sd := range t.HTTPSDConfigs {
+			if err := sd.validate(); err != nil {
+				return fmt.Errorf("http_sd_configs %d for %s: %w", i, desc, err)
+			}
+		}
+		return nil
+	}
+
+	// Like Prometheus, the instance defaults to the host:port being scraped
+	return t.resolve(initialTargetLabels(u, t.Job, t.Instance, t.Labels), u.Query())
+}
+
+// resolve applies relabel_configs to the target's initial labels and sets its
+// scrape URL and target labels, or marks it dropped. query is the parameters
+// of a static target's url.
+func (t *TargetConfig) resolve(initial labels.Labels, query url.Values) error {
+	scrapeURL, lbls, keep, err := resolveTarget(initial, query, t.RelabelConfigs)
+	if err != nil {
+		return fmt.Errorf("relabel_configs for %s: %w", initial.Get(model.AddressLabel), err)
+	}
+	if !keep {
+		t.dropped = true
+		return nil
+	}
+
+	t.scrapeURL = scrapeURL
+	t.labels = prompb.FromLabels(lbls, nil)
+	t.Job = lbls.Get(model.JobLabel)
+	t.Instance = lbls.Get(model.InstanceLabel)
+
+	return nil
+}
+
+// hasDiscovery reports whether the target is a template for discovered targets
+func (t *TargetConfig) hasDiscovery() bool {
+	return len(t.KubernetesSDConfigs) > 0 || len(t.FileSDConfigs) > 0 || len(t.HTTPSDConfigs) > 0
+}
+
+// targetLabels returns the job, instance and extra labels attached to every
+// series scraped from the target, sorted by name
+func (t *TargetConfig) targetLabels() []prompb.Label {
+	return t.labels
+}
+
+func (t *TargetConfig) String() string {
+	return fmt.Sprintf("%s/%s", t.Job, t.Instance)
+}
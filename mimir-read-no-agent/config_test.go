@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func loadTestConfig(t *testing.T, config string, overrides configOverrides) (*Config, error) {
+	path := filepath.Join(t.TempDir(), "bridge.yml")
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return loadConfig(path, overrides)
+}
+
+func TestConfigRemoteWriteURL(t *testing.T) {
+	const targets = `
+targets:
+  - url: http://localhost:8080/metrics
+    job: test
+`
+	for _, tc := range []struct {
+		name      string
+		config    string
+		overrides configOverrides
+		wantURLs  []string
+		err       string
+	}{
+		{
+			name:     "no remote_write",
+			config:   targets,
+			wantURLs: []string{defaultRemoteWriteURL},
+		},
+		{
+			name:     "single endpoint without url",
+			config:   "remote_write:\n  tenant: demo\n" + targets,
+			wantURLs: []string{defaultRemoteWriteURL},
+		},
+		{
+			name:     "list",
+			config:   "remote_write:\n  - url: http://mimir:9009/api/v1/push\n  - name: staging\n    url: http://staging:9009/api/v1/push\n" + targets,
+			wantURLs: []string{"http://mimir:9009/api/v1/push", "http://staging:9009/api/v1/push"},
+		},
+		{
+			name:   "list entry without url",
+			config: "remote_write:\n  - url: http://mimir:9009/api/v1/push\n  - name: staging\n" + targets,
+			err:    "remote_write 1: url is required",
+		},
+		{
+			name:      "flag sets the url of the first entry",
+			config:    "remote_write:\n  - tenant: demo\n" + targets,
+			overrides: configOverrides{remoteWriteURL: "http://flag:9009/api/v1/push"},
+			wantURLs:  []string{"http://flag:9009/api/v1/push"},
+		},
+		{
+			name:   "second entry without name",
+			config: "remote_write:\n  - url: http://mimir:9009/api/v1/push\n  - url: http://staging:9009/api/v1/push\n" + targets,
+			err:    "name is required",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := loadTestConfig(t, tc.config, tc.overrides)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got %v, want an error containing %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var urls []string
+			for _, rw := range cfg.RemoteWrite {
+				urls = append(urls, rw.URL)
+			}
+			if !slices.Equal(urls, tc.wantURLs) {
+				t.Errorf("got urls %v, want %v", urls, tc.wantURLs)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// discoverer finds scrape targets in an external system. run sends the
+// complete list of discovered label sets whenever it changes, until ctx is
+// cancelled. Each label set holds __address__ plus __meta_* labels, which
+// relabel_configs can use and which are removed before scraping.
+type discoverer interface {
+	run(ctx context.Context, updates chan<- []labels.Labels)
+}
+
+// pollDiscovery calls discover every interval and sends its result when it
+// changed. On errors the last result stays in effect.
+func pollDiscovery(ctx context.Context, interval time.Duration, source string, discover func(context.Context) ([]labels.Labels, error), updates chan<- []labels.Labels) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last []labels.Labels
+	sent := false
+	for {
+		lsets, err := discover(ctx)
+		switch {
+		case err != nil:
+			if ctx.Err() == nil {
+				log.Printf("Error discovering %s: %v\n", source, err)
+			}
+		case !sent || !equalLabelSets(lsets, last):
+			select {
+			case updates <- lsets:
+			case <-ctx.Done():
+				return
+			}
+			last, sent = lsets, true
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// discoverers returns the discoverers of a template, keyed by the config they come from
+func (t *TargetConfig) discoverers() map[string]discoverer {
+	ds := make(map[string]discoverer)
+	for i, sd := range t.KubernetesSDConfigs {
+		ds[fmt.Sprintf("kubernetes_sd_configs/%d", i)] = sd.discoverer()
+	}
+	for i, sd := range t.FileSDConfigs {
+		ds[fmt.Sprintf("file_sd_configs/%d", i)] = sd.discoverer()
+	}
+	for i, sd := range t.HTTPSDConfigs {
+		ds[fmt.Sprintf("http_sd_configs/%d", i)] = sd.discoverer()
+	}
+	return ds
+}
+
+// discoveredTarget builds the target for a discovered label set from the
+// template. Labels set by discovery win over the template's; job, __scheme__
+// and __metrics_path__ are filled in when discovery did not set them.
+func (t *TargetConfig) discoveredTarget(lbls labels.Labels) (*TargetConfig, error) {
+	b := labels.NewBuilder(lbls)
+	for name, value := range t.Labels {
+		if lbls.Get(name) == "" {
+			b.Set(name, value)
+		}
+	}
+	b.Set(model.JobLabel, t.Job)
+	if lbls.Get(model.SchemeLabel) == "" {
+		b.Set(model.SchemeLabel, "http")
+	}
+	if lbls.Get(model.MetricsPathLabel) == "" {
+		b.Set(model.MetricsPathLabel, "/metrics")
+	}
+
+	target := *t
+	target.KubernetesSDConfigs = nil
+	target.FileSDConfigs = nil
+	target.HTTPSDConfigs = nil
+	if err := target.resolve(b.Labels(), nil); err != nil {
+		return nil, err
+	}
+
+	return &target, nil
+}
+
+// runDiscovery turns the label sets of one discoverer into targets and hands
+// them to the bridge until ctx is cancelled
+func (b *bridge) runDiscovery(ctx context.Context, key string, template *TargetConfig, d discoverer) {
+	updates := make(chan []labels.Labels)
+	go d.run(ctx, updates)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case lsets := <-updates:
+			var targets []*TargetConfig
+			for _, lbls := range lsets {
+				target, err := template.discoveredTarget(lbls)
+				if err != nil {
+					log.Printf("[%s] Skipping discovered target: %v\n", key, err)
+					continue
+				}
+				if target.dropped {
+					continue
+				}
+				targets = append(targets, target)
+			}
+
+			log.Printf("[%s] Discovered %d targets\n", key, len(targets))
+			b.updateDiscovered(ctx, key, targets)
+		}
+	}
+}
+
+// targetGroup is the file_sd and http_sd format: a list of host:port
+// addresses sharing a set of labels
+type targetGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+}
+
+// targetGroupLabels returns a label set per address in the groups, with the
+// group labels and the extra labels naming where the groups came from
+func targetGroupLabels(groups []targetGroup, extra map[string]string) ([]labels.Labels, error) {
+	var lsets []labels.Labels
+	for i, g := range groups {
+		for name := range g.Labels {
+			if !model.LabelName(name).IsValid() {
+				return nil, fmt.Errorf("group %d: invalid label name %q", i, name)
+			}
+		}
+
+		for _, addr := range g.Targets {
+			if addr == "" {
+				return nil, fmt.Errorf("group %d: empty target", i)
+			}
+
+			b := labels.NewBuilder(labels.FromMap(g.Labels))
+			for name, value := range extra {
+				b.Set(name, value)
+			}
+			b.Set(model.AddressLabel, addr)
+			lsets = append(lsets, b.Labels())
+		}
+	}
+	return lsets, nil
+}
+
+func equalLabelSets(a, b []labels.Labels) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !labels.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// convertExemplars turns scraped exemplars into remote write exemplars. Like
+// Prometheus, exemplars without a timestamp get the sample's.
+func convertExemplars(exemplars []*io_prometheus_client.Exemplar, timestamp int64) []prompb.Exemplar {
+	var converted []prompb.Exemplar
+	for _, e := range exemplars {
+		if e == nil {
+			continue
+		}
+
+		ex := prompb.Exemplar{Value: e.GetValue(), Timestamp: timestamp}
+		if e.Timestamp != nil {
+			ex.Timestamp = e.Timestamp.AsTime().UnixMilli()
+		}
+		for _, l := range e.GetLabel() {
+			ex.Labels = append(ex.Labels, prompb.Label{Name: l.GetName(), Value: l.GetValue()})
+		}
+		converted = append(converted, ex)
+	}
+	return converted
+}
+
+// exemplarTracker remembers the newest exemplar sent for each series of a
+// target. Targets keep exposing the last exemplar of a series until a new
+// one is recorded, so without this the same trace would be sent on every
+// scrape.
+type exemplarTracker struct {
+	last map[uint64]prompb.Exemplar
+}
+
+func newExemplarTracker() *exemplarTracker {
+	return &exemplarTracker{last: make(map[uint64]prompb.Exemplar)}
+}
+
+// filter removes exemplars already sent for their series, then keeps at most
+// limit exemplars per scrape if limit is above 0. An exemplar counts as sent
+// if it is not newer than the last one, or, for exemplars stamped with the
+// scrape time, if it has the same value and labels. It returns the number of
+// exemplars dropped by the limit.
+func (t *exemplarTracker) filter(series []bridgeSeries, limit int) int {
+	last := make(map[uint64]prompb.Exemplar)
+	kept, dropped := 0, 0
+
+	for i := range series {
+		s := &series[i]
+		if len(s.Exemplars) == 0 {
+			continue
+		}
+
+		hash := toLabels(s.Labels).Hash()
+		prev, sent := t.last[hash]
+		newest, seen := prev, sent
+		exemplars := s.Exemplars[:0]
+		for _, e := range s.Exemplars {
+			if sent && (e.Timestamp <= prev.Timestamp || sameExemplar(e, prev)) {
+				continue
+			}
+			if limit > 0 && kept >= limit {
+				dropped++
+				continue
+			}
+			exemplars = append(exemplars, e)
+			kept++
+			if !seen || e.Timestamp > newest.Timestamp {
+				newest, seen = e, true
+			}
+		}
+		if seen {
+			last[hash] = newest
+		}
+
+		if len(exemplars) == 0 {
+			exemplars = nil
+		}
+		s.Exemplars = exemplars
+	}
+
+	t.last = last
+	return dropped
+}
+
+func sameExemplar(a, b prompb.Exemplar) bool {
+	if a.Value != b.Value || len(a.Labels) != len(b.Labels) {
+		return false
+	}
+	for i := range a.Labels {
+		if a.Labels[i].Name != b.Labels[i].Name || a.Labels[i].Value != b.Labels[i].Value {
+			return false
+		}
+	}
+	return true
+}
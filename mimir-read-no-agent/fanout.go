@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"sync"
+)
+
+// fanoutWriter writes every series to each remote_write endpoint. Endpoints
+// have their own WAL, queues, retries, auth and tenants, and writes only
+// wait for the WAL, so an endpoint that is down or slow does not hold back
+// the others.
+type fanoutWriter struct {
+	mu        sync.RWMutex
+	endpoints []*remoteWriter
+}
+
+// newFanoutWriter starts the remote writer of every endpoint
+func newFanoutWriter(rws []*RemoteWriteConfig, walCfg WALConfig) (*fanoutWriter, error) {
+	f := &fanoutWriter{}
+	if err := f.reload(rws, walCfg); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// endpointsWALDir holds the WAL directories of the endpoints after the first.
+// validateTenantID rejects it, so no tenant directory of the first endpoint
+// uses this name.
+const endpointsWALDir = "remote_write"
+
+// endpointWAL returns the WAL settings of the i-th endpoint. The first one
+// uses the WAL directory itself, as before fan-out, so adding endpoints does
+// not move its records; the others get a directory named after them.
+func endpointWAL(walCfg WALConfig, rw *RemoteWriteConfig, i int) WALConfig {
+	if i > 0 {
+		walCfg.Directory = filepath.Join(walCfg.Directory, endpointsWALDir, rw.Name)
+	}
+	return walCfg
+}
+
+// reload restarts the endpoints whose settings changed, starts new ones and
+// stops the ones removed. Unchanged endpoints keep their queues. The HTTP
+// clients are built first, so a bad auth setting leaves every endpoint as it was.
+func (f *fanoutWriter) reload(rws []*RemoteWriteConfig, walCfg WALConfig) error {
+	clients := make([]*http.Client, len(rws))
+	for i, rw := range rws {
+		client, err := newPushClient(*rw)
+		if err != nil {
+			return err
+		}
+		clients[i] = client
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	current := make(map[string]*remoteWriter, len(f.endpoints))
+	for _, w := range f.endpoints {
+		current[w.walCfg.Directory] = w
+	}
+
+	// Endpoints started by a reload that fails are stopped again
+	var started []*remoteWriter
+	fail := func(err error) error {
+		for _, w := range started {
+			w.stop()
+		}
+		return err
+	}
+
+	endpoints := make([]*remoteWriter, 0, len(rws))
+	for i, rw := range rws {
+		epWAL := endpointWAL(walCfg, rw, i)
+		w, ok := current[epWAL.Directory]
+		delete(current, epWAL.Directory)
+
+		switch {
+		case ok && reflect.DeepEqual(w.rw, *rw) && reflect.DeepEqual(w.walCfg, epWAL):
+		case ok:
+			log.Printf("Restarting remote write queues for %s\n", rw.URL)
+			if err := w.reload(clients[i], *rw, epWAL); err != nil {
+				return fail(fmt.Errorf("failed to reload remote write to %s: %w", rw.URL, err))
+			}
+		default:
+			var err error
+			if w, err = newRemoteWriter(clients[i], *rw, epWAL); err != nil {
+				return fail(fmt.Errorf("failed to open WAL for %s: %w", rw.URL, err))
+			}
+			started = append(started, w)
+		}
+		endpoints = append(endpoints, w)
+	}
+
+	for _, w := range current {
+		log.Printf("Stopping remote write to %s, unsent samples stay in %s\n", w.rw.URL, w.walCfg.Directory)
+		w.stop()
+	}
+
+	f.endpoints = endpoints
+	return nil
+}
+
+// write hands the series to every endpoint. An endpoint failing to write
+// its WAL does not keep the series from the others.
+func (f *fanoutWriter) write(timeseries []bridgeSeries, targetTenant string) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	var errs []error
+	for _, w := range f.endpoints {
+		if err := w.write(timeseries, targetTenant); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", w.rw.URL, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// abort makes every endpoint give up sending, leaving unsent samples in the WAL
+func (f *fanoutWriter) abort() {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	for _, w := range f.endpoints {
+		w.abort()
+	}
+}
+
+// drain sends what every endpoint holds until ctx is done. Endpoints are
+// drained in parallel so one that is down does not use up the time of the others.
+func (f *fanoutWriter) drain(ctx context.Context) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, w := range f.endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.drain(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+// urls returns the URL of every endpoint, for logging
+func (f *fanoutWriter) urls() []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	urls := make([]string, len(f.endpoints))
+	for i, w := range f.endpoints {
+		urls[i] = w.rw.URL
+	}
+	return urls
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func teamSeries(name, team string) bridgeSeries {
+	s := testSeries(name, 1000, 1)
+	if team != "" {
+		s.Labels = append(s.Labels, prompb.Label{Name: "team", Value: team})
+	}
+	return s
+}
+
+// tenantsByName maps the name of every series a receiver got to its tenant
+func tenantsByName(t *testing.T, recv *testReceiver) map[string]string {
+	t.Helper()
+	got := make(map[string]string)
+	for _, s := range recv.received() {
+		name := labelValue(s.Labels, model.MetricNameLabel)
+		if tenant, ok := got[name]; ok && tenant != s.tenant {
+			t.Errorf("%s sent to tenants %q and %q", name, tenant, s.tenant)
+		}
+		got[name] = s.tenant
+	}
+	return got
+}
+
+func TestFanoutTenantRouting(t *testing.T) {
+	prod := newTestReceiver(t)
+	staging := newTestReceiver(t)
+
+	cfg, err := loadTestConfig(t, fmt.Sprintf(`
+remote_write:
+  - url: %s
+    tenant: prod-default
+    tenant_rules:
+      - source_labels: [team]
+  - name: staging
+    url: %s
+    tenant: staging
+    write_relabel_configs:
+      - source_labels: [team]
+        regex: "y"
+        action: drop
+targets:
+  - url: http://localhost:8080/metrics
+    job: test
+`, prod.URL, staging.URL), configOverrides{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, rw := range cfg.RemoteWrite {
+		test := testRemoteWriteConfig(rw.URL)
+		test.Name, test.Tenant, test.TenantRules, test.WriteRelabelConfigs = rw.Name, rw.Tenant, rw.TenantRules, rw.WriteRelabelConfigs
+		cfg.RemoteWrite[i] = &test
+	}
+	writer := newTestWriter(t, cfg.RemoteWrite...)
+
+	// Tenant rules win over the target's tenant, which wins over the endpoint's
+	if err := writer.write([]bridgeSeries{
+		teamSeries("x_total", "x"),
+		teamSeries("y_total", "y"),
+		teamSeries("none_total", ""),
+		teamSeries("invalid_total", "a/b"),
+	}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.write([]bridgeSeries{teamSeries("target_total", "")}, "target"); err != nil {
+		t.Fatal(err)
+	}
+	drainWriter(t, writer)
+
+	wantProd := map[string]string{"x_total": "x", "y_total": "y", "none_total": "prod-default", "target_total": "target"}
+	if got := tenantsByName(t, prod); !maps.Equal(got, wantProd) {
+		t.Errorf("prod got %v, want %v", got, wantProd)
+	}
+	wantStaging := map[string]string{"x_total": "staging", "none_total": "staging", "invalid_total": "staging", "target_total": "target"}
+	if got := tenantsByName(t, staging); !maps.Equal(got, wantStaging) {
+		t.Errorf("staging got %v, want %v", got, wantStaging)
+	}
+}
+
+func TestFanoutEndpointDown(t *testing.T) {
+	up := newTestReceiver(t)
+	down := newTestReceiver(t)
+	down.setRespond(func(n int, w http.ResponseWriter) int {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return http.StatusServiceUnavailable
+	})
+
+	rwUp := testRemoteWriteConfig(up.URL)
+	rwDown := testRemoteWriteConfig(down.URL)
+	rwDown.Name = "down"
+	writer := newTestWriter(t, &rwUp, &rwDown)
+
+	for i := range 3 {
+		if err := writer.write([]bridgeSeries{testSeries("a_total", int64(i), 1)}, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "the healthy endpoint to receive every sample", func() bool { return up.sampleCount() == 3 })
+
+	waitFor(t, "the failing endpoint to be retried", func() bool { return down.requestCount() > 1 })
+	if n := down.sampleCount(); n != 0 {
+		t.Errorf("failing endpoint accepted %d samples", n)
+	}
+}
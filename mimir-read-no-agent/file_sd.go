@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"go.yaml.in/yaml/v2"
+)
+
+const (
+	fileSDFilepathLabel = model.MetaLabelPrefix + "filepath"
+
+	defaultFileSDRefreshInterval = 5 * time.Second
+)
+
+// FileSDConfig reads targets from files in the format of Prometheus'
+// file_sd_configs: a JSON or YAML list of target groups
+//
+//	[{"targets": ["host:9100"], "labels": {"team": "infra"}}]
+//
+// The files are checked every refresh_interval and re-read when they change.
+type FileSDConfig struct {
+	// Files are paths or globs ending in .json, .yml or .yaml, relative to the config file
+	Files           []string       `yaml:"files"`
+	RefreshInterval model.Duration `yaml:"refresh_interval,omitempty"`
+}
+
+func (c *FileSDConfig) setDirectory(dir string) {
+	for i, f := range c.Files {
+		if !filepath.IsAbs(f) {
+			c.Files[i] = filepath.Join(dir, f)
+		}
+	}
+}
+
+func (c *FileSDConfig) validate() error {
+	if len(c.Files) == 0 {
+		return fmt.Errorf("files is required")
+	}
+	for _, f := range c.Files {
+		if _, err := filepath.Match(f, ""); err != nil {
+			return fmt.Errorf("invalid file pattern %q: %w", f, err)
+		}
+		switch filepath.Ext(f) {
+		case ".json", ".yml", ".yaml":
+		default:
+			return fmt.Errorf("file %q must end in .json, .yml or .yaml", f)
+		}
+	}
+
+	if c.RefreshInterval == 0 {
+		c.RefreshInterval = model.Duration(defaultFileSDRefreshInterval)
+	}
+	if c.RefreshInterval < 0 {
+		return fmt.Errorf("refresh_interval must be positive")
+	}
+
+	return nil
+}
+
+func (c *FileSDConfig) discoverer() discoverer {
+	return &fileDiscovery{cfg: c, files: make(map[string]*fileTargets)}
+}
+
+// fileDiscovery polls the files every refresh_interval
+type fileDiscovery struct {
+	cfg *FileSDConfig
+	// files holds the targets last read from each file
+	files map[string]*fileTargets
+}
+
+type fileTargets struct {
+	modTime time.Time
+	size    int64
+	lsets   []labels.Labels
+}
+
+func (d *fileDiscovery) run(ctx context.Context, updates chan<- []labels.Labels) {
+	source := "targets from " + strings.Join(d.cfg.Files, ", ")
+	pollDiscovery(ctx, time.Duration(d.cfg.RefreshInterval), source, d.discover, updates)
+}
+
+// discover returns the targets of every matching file. A file that cannot be
+// read or parsed keeps the targets it had before, like in Prometheus.
+func (d *fileDiscovery) discover(_ context.Context) ([]labels.Labels, error) {
+	var paths []string
+	for _, pattern := range d.cfg.Files {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("failed to match %s: %w", pattern, err)
+		}
+		paths = append(paths, matches...)
+	}
+	sort.Strings(paths)
+
+	seen := make(map[string]bool, len(paths))
+	var lsets []labels.Labels
+	for _, path := range paths {
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+
+		if err := d.refresh(path); err != nil {
+			log.Printf("Error reading file_sd file %s: %v\n", path, err)
+		}
+		if ft, ok := d.files[path]; ok {
+			lsets = append(lsets, ft.lsets...)
+		}
+	}
+
+	// Targets of deleted files go away
+	for path := range d.files {
+		if !seen[path] {
+			delete(d.files, path)
+		}
+	}
+
+	return lsets, nil
+}
+
+// refresh re-reads a file if its size or modification time changed
+func (d *fileDiscovery) refresh(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	ft, ok := d.files[path]
+	if ok && ft.modTime.Equal(info.ModTime()) && ft.size == info.Size() {
+		return nil
+	}
+	if !ok {
+		ft = &fileTargets{}
+		d.files[path] = ft
+	}
+	// A broken file is reported once per change rather than on every poll
+	ft.modTime, ft.size = info.ModTime(), info.Size()
+
+	lsets, err := readTargetGroups(path)
+	if err != nil {
+		return err
+	}
+	ft.lsets = lsets
+	return nil
+}
+
+func readTargetGroups(path string) ([]labels.Labels, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []targetGroup
+	switch filepath.Ext(path) {
+	case ".json":
+		err = json.Unmarshal(data, &groups)
+	default:
+		err = yaml.UnmarshalStrict(data, &groups)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse: %w", err)
+	}
+
+	return targetGroupLabels(groups, map[string]string{fileSDFilepathLabel: path})
+}
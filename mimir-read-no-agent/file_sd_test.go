@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+func writeTargetFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Make every write visible to the size and modification time check
+	mtime := time.Now().Add(time.Duration(len(content)) * time.Second)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func addresses(lsets []labels.Labels) []string {
+	var addrs []string
+	for _, lset := range lsets {
+		addrs = append(addrs, lset.Get(model.AddressLabel))
+	}
+	slices.Sort(addrs)
+	return addrs
+}
+
+func TestFileSDConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  FileSDConfig
+		err  string
+	}{
+		{"no files", FileSDConfig{}, "files is required"},
+		{"bad extension", FileSDConfig{Files: []string{"targets.txt"}}, "must end in .json, .yml or .yaml"},
+		{"bad pattern", FileSDConfig{Files: []string{"[.json"}}, "invalid file pattern"},
+		{"negative refresh", FileSDConfig{Files: []string{"a.json"}, RefreshInterval: model.Duration(-time.Second)}, "refresh_interval must be positive"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.cfg.validate(); err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("got %v, want an error containing %q", err, tc.err)
+			}
+		})
+	}
+
+	cfg := FileSDConfig{Files: []string{"targets/*.json", "/etc/targets.yml"}}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RefreshInterval != model.Duration(defaultFileSDRefreshInterval) {
+		t.Errorf("got refresh_interval %v, want the default", cfg.RefreshInterval)
+	}
+	cfg.setDirectory("/config")
+	if !slices.Equal(cfg.Files, []string{"/config/targets/*.json", "/etc/targets.yml"}) {
+		t.Errorf("got files %v, want relative paths under the config directory", cfg.Files)
+	}
+}
+
+func TestFileSDDiscover(t *testing.T) {
+	dir := t.TempDir()
+	jsonFile := filepath.Join(dir, "web.json")
+	yamlFile := filepath.Join(dir, "db.yml")
+	writeTargetFile(t, jsonFile, `[{"targets": ["web-1:8080", "web-2:8080"], "labels": {"team": "web"}}]`)
+	writeTargetFile(t, yamlFile, "- targets: [db-1:9187]\n  labels:\n    team: db\n")
+
+	cfg := &FileSDConfig{Files: []string{filepath.Join(dir, "*.json"), yamlFile, jsonFile}}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	d := cfg.discoverer().(*fileDiscovery)
+
+	lsets, err := d.discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A file matched by several patterns is read once
+	if got := addresses(lsets); !slices.Equal(got, []string{"db-1:9187", "web-1:8080", "web-2:8080"}) {
+		t.Fatalf("got targets %v", got)
+	}
+	for _, lset := range lsets {
+		want := map[string]string{"team": "web", fileSDFilepathLabel: jsonFile}
+		if strings.HasPrefix(lset.Get(model.AddressLabel), "db") {
+			want = map[string]string{"team": "db", fileSDFilepathLabel: yamlFile}
+		}
+		checkLabels(t, lset, want)
+	}
+
+	// A broken file keeps its last good targets
+	writeTargetFile(t, jsonFile, `[{"targets": ["web-1:8080"]`)
+	lsets, err = d.discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := addresses(lsets); !slices.Equal(got, []string{"db-1:9187", "web-1:8080", "web-2:8080"}) {
+		t.Errorf("got targets %v after breaking a file, want the previous ones", got)
+	}
+
+	// An invalid label name is rejected the same way
+	writeTargetFile(t, yamlFile, "- targets: [db-2:9187]\n  labels:\n    \"\": db\n")
+	lsets, err = d.discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := addresses(lsets); !slices.Contains(got, "db-1:9187") || slices.Contains(got, "db-2:9187") {
+		t.Errorf("got targets %v after an invalid label name, want the previous ones", got)
+	}
+
+	// A fixed file is picked up and a deleted one drops its targets
+	writeTargetFile(t, jsonFile, `[{"targets": ["web-3:8080"]}]`)
+	if err := os.Remove(yamlFile); err != nil {
+		t.Fatal(err)
+	}
+	lsets, err = d.discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := addresses(lsets); !slices.Equal(got, []string{"web-3:8080"}) {
+		t.Errorf("got targets %v, want only the fixed file's", got)
+	}
+	if _, ok := d.files[yamlFile]; ok {
+		t.Error("deleted file is still tracked")
+	}
+}
+
+func TestFileSDTargets(t *testing.T) {
+	dir := t.TempDir()
+	writeTargetFile(t, filepath.Join(dir, "targets.json"), `[{"targets": ["app:8080"], "labels": {"__metrics_path__": "/stats", "env": "prod"}}]`)
+
+	cfg, err := loadTestConfig(t, `
+targets:
+  - job: files
+    file_sd_configs:
+      - files: [`+filepath.Join(dir, "*.json")+`]
+    relabel_configs:
+      - source_labels: [__meta_filepath]
+        regex: .*/(.*)\.json
+        target_label: source
+`, configOverrides{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := cfg.Targets[0]
+	lsets, err := template.FileSDConfigs[0].discoverer().(*fileDiscovery).discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := template.discoveredTarget(lsets[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.scrapeURL != "http://app:8080/stats" {
+		t.Errorf("got scrape url %s", target.scrapeURL)
+	}
+	want := map[string]string{"job": "files", "instance": "app:8080", "env": "prod", "source": "targets", fileSDFilepathLabel: ""}
+	for name, value := range want {
+		if got := labelValue(target.targetLabels(), name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestTargetGroupLabels(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		groups []targetGroup
+		err    string
+	}{
+		{"invalid label name", []targetGroup{{Targets: []string{"a:80"}}, {Targets: []string{"b:80"}, Labels: map[string]string{"": "x"}}}, "group 1: invalid label name"},
+		{"empty target", []targetGroup{{Targets: []string{"a:80", ""}}}, "group 0: empty target"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := targetGroupLabels(tc.groups, nil)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("got %v, want an error containing %q", err, tc.err)
+			}
+		})
+	}
+
+	// The labels naming the source win over group labels of the same name
+	lsets, err := targetGroupLabels([]targetGroup{{Targets: []string{"a:80"}, Labels: map[string]string{"team": "x", fileSDFilepathLabel: "spoofed"}}}, map[string]string{fileSDFilepathLabel: "a.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lsets) != 1 {
+		t.Fatalf("got %d label sets, want 1", len(lsets))
+	}
+	checkLabels(t, lsets[0], map[string]string{model.AddressLabel: "a:80", "team": "x", fileSDFilepathLabel: "a.json"})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// convertHistogram turns a scraped histogram into remote write series. Classic
+// buckets become <name>_bucket{le="..."}, <name>_sum and <name>_count series;
+// native (sparse) buckets are sent as a single prompb.Histogram on <name>.
+// Gauge histograms use the OpenMetrics _gsum and _gcount names instead. A
+// native histogram only keeps its classic buckets when classic is set.
+// Bucket exemplars go on their _bucket series, native ones on <name>.
+func convertHistogram(name string, b *labelBuilder, h *io_prometheus_client.Histogram, gauge, classic bool, timestamp int64) []prompb.TimeSeries {
+	var timeseries []prompb.TimeSeries
+
+	native := isNativeHistogram(h)
+	if native {
+		timeseries = append(timeseries, prompb.TimeSeries{
+			Labels:     b.labels(name),
+			Histograms: []prompb.Histogram{nativeHistogram(h, gauge, timestamp)},
+			Exemplars:  convertExemplars(h.GetExemplars(), timestamp),
+		})
+	}
+
+	// A native histogram may also expose classic buckets, sent only when
+	// asked for; a histogram with neither is still sent as classic so _sum
+	// and _count are not lost
+	if native && (!classic || len(h.GetBucket()) == 0) {
+		return timeseries
+	}
+
+	count := float64(h.GetSampleCount())
+	if h.GetSampleCountFloat() > 0 {
+		count = h.GetSampleCountFloat()
+	}
+
+	hasInf := false
+	for _, bucket := range h.GetBucket() {
+		value := float64(bucket.GetCumulativeCount())
+		if bucket.GetCumulativeCountFloat() > 0 {
+			value = bucket.GetCumulativeCountFloat()
+		}
+		if math.IsInf(bucket.GetUpperBound(), +1) {
+			hasInf = true
+		}
+
+		timeseries = append(timeseries, prompb.TimeSeries{
+			Labels: b.labels(name+"_bucket", prompb.Label{
+				Name:  model.BucketLabel,
+				Value: formatFloat(bucket.GetUpperBound()),
+			}),
+			Samples:   []prompb.Sample{{Value: value, Timestamp: timestamp}},
+			Exemplars: convertExemplars([]*io_prometheus_client.Exemplar{bucket.GetExemplar()}, timestamp),
+		})
+	}
+
+	// The +Inf bucket is implicit in some expositions but histogram_quantile needs it
+	if !hasInf {
+		timeseries = append(timeseries, prompb.TimeSeries{
+			Labels:  b.labels(name+"_bucket", prompb.Label{Name: model.BucketLabel, Value: "+Inf"}),
+			Samples: []prompb.Sample{{Value: count, Timestamp: timestamp}},
+		})
+	}
+
+	sumSuffix, countSuffix := "_sum", "_count"
+	if gauge {
+		sumSuffix, countSuffix = "_gsum", "_gcount"
+	}
+	timeseries = append(timeseries,
+		prompb.TimeSeries{
+			Labels:  b.labels(name + sumSuffix),
+			Samples: []prompb.Sample{{Value: h.GetSampleSum(), Timestamp: timestamp}},
+		},
+		prompb.TimeSeries{
+			Labels:  b.labels(name + countSuffix),
+			Samples: []prompb.Sample{{Value: count, Timestamp: timestamp}},
+		},
+	)
+
+	return timeseries
+}
+
+// isNativeHistogram reports whether h carries sparse buckets, using the same
+// rule as the Prometheus protobuf parser
+func isNativeHistogram(h *io_prometheus_client.Histogram) bool {
+	return len(h.GetPositiveSpan()) > 0 ||
+		len(h.GetNegativeSpan()) > 0 ||
+		h.GetZeroThreshold() > 0 ||
+		h.GetZeroCount() > 0 ||
+		h.GetZeroCountFloat() > 0
+}
+
+// nativeHistogram copies the sparse buckets of h into a remote write histogram.
+// Integer histograms keep their delta encoding, float histograms use absolute counts.
+func nativeHistogram(h *io_prometheus_client.Histogram, gauge bool, timestamp int64) prompb.Histogram {
+	ph := prompb.Histogram{
+		Sum:            h.GetSampleSum(),
+		Schema:         h.GetSchema(),
+		ZeroThreshold:  h.GetZeroThreshold(),
+		NegativeSpans:  bucketSpans(h.GetNegativeSpan()),
+		PositiveSpans:  bucketSpans(h.GetPositiveSpan()),
+		ResetHint:      prompb.Histogram_UNKNOWN,
+		Timestamp:      timestamp,
+		NegativeDeltas: h.GetNegativeDelta(),
+		PositiveDeltas: h.GetPositiveDelta(),
+	}
+	if gauge {
+		ph.ResetHint = prompb.Histogram_GAUGE
+	}
+
+	if h.GetSampleCountFloat() > 0 || h.GetZeroCountFloat() > 0 {
+		ph.Count = &prompb.Histogram_CountFloat{CountFloat: h.GetSampleCountFloat()}
+		ph.ZeroCount = &prompb.Histogram_ZeroCountFloat{ZeroCountFloat: h.GetZeroCountFloat()}
+		ph.NegativeDeltas = nil
+		ph.PositiveDeltas = nil
+		ph.NegativeCounts = h.GetNegativeCount()
+		ph.PositiveCounts = h.GetPositiveCount()
+	} else {
+		ph.Count = &prompb.Histogram_CountInt{CountInt: h.GetSampleCount()}
+		ph.ZeroCount = &prompb.Histogram_ZeroCountInt{ZeroCountInt: h.GetZeroCount()}
+	}
+
+	return ph
+}
+
+func bucketSpans(spans []*io_prometheus_client.BucketSpan) []prompb.BucketSpan {
+	if len(spans) == 0 {
+		return nil
+	}
+	out := make([]prompb.BucketSpan, 0, len(spans))
+	for _, s := range spans {
+		out = append(out, prompb.BucketSpan{Offset: s.GetOffset(), Length: s.GetLength()})
+	}
+	return out
+}
+
+// formatFloat renders a float label value (le, quantile) the way the text exposition format does
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, +1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
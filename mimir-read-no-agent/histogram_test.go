@@ -0,0 +1,164 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"google.golang.org/protobuf/proto"
+)
+
+// histogramSeries names the converted series, with the le of buckets, mapped to their value
+func histogramSeries(t *testing.T, timeseries []prompb.TimeSeries) map[string]float64 {
+	t.Helper()
+	got := make(map[string]float64)
+	for _, ts := range timeseries {
+		name := labelValue(ts.Labels, model.MetricNameLabel)
+		if le := labelValue(ts.Labels, model.BucketLabel); le != "" {
+			name += "{" + le + "}"
+		}
+		if len(ts.Histograms) > 0 {
+			got[name+"[native]"] = ts.Histograms[0].Sum
+			continue
+		}
+		got[name] = ts.Samples[0].Value
+	}
+	return got
+}
+
+func classicBuckets(bounds []float64, counts []uint64) []*io_prometheus_client.Bucket {
+	var buckets []*io_prometheus_client.Bucket
+	for i, bound := range bounds {
+		buckets = append(buckets, &io_prometheus_client.Bucket{UpperBound: proto.Float64(bound), CumulativeCount: proto.Uint64(counts[i])})
+	}
+	return buckets
+}
+
+func TestConvertHistogram(t *testing.T) {
+	native := func(h *io_prometheus_client.Histogram) *io_prometheus_client.Histogram {
+		h.Schema = proto.Int32(0)
+		h.ZeroThreshold = proto.Float64(1e-128)
+		h.PositiveSpan = []*io_prometheus_client.BucketSpan{{Offset: proto.Int32(0), Length: proto.Uint32(2)}}
+		h.PositiveDelta = []int64{1, 1}
+		return h
+	}
+
+	for _, tc := range []struct {
+		name           string
+		h              *io_prometheus_client.Histogram
+		gauge, classic bool
+		want           map[string]float64
+	}{
+		{
+			name: "classic",
+			h:    &io_prometheus_client.Histogram{SampleCount: proto.Uint64(4), SampleSum: proto.Float64(2.5), Bucket: classicBuckets([]float64{0.1, 1, math.Inf(+1)}, []uint64{1, 3, 4})},
+			want: map[string]float64{"h_bucket{0.1}": 1, "h_bucket{1}": 3, "h_bucket{+Inf}": 4, "h_sum": 2.5, "h_count": 4},
+		},
+		{
+			name: "missing +Inf bucket is added",
+			h:    &io_prometheus_client.Histogram{SampleCount: proto.Uint64(4), SampleSum: proto.Float64(2.5), Bucket: classicBuckets([]float64{0.1, 1}, []uint64{1, 3})},
+			want: map[string]float64{"h_bucket{0.1}": 1, "h_bucket{1}": 3, "h_bucket{+Inf}": 4, "h_sum": 2.5, "h_count": 4},
+		},
+		{
+			name: "no buckets",
+			h:    &io_prometheus_client.Histogram{SampleCount: proto.Uint64(2), SampleSum: proto.Float64(1)},
+			want: map[string]float64{"h_bucket{+Inf}": 2, "h_sum": 1, "h_count": 2},
+		},
+		{
+			name: "float counts",
+			h: &io_prometheus_client.Histogram{SampleCountFloat: proto.Float64(2.5), SampleSum: proto.Float64(1), Bucket: []*io_prometheus_client.Bucket{
+				{UpperBound: proto.Float64(1), CumulativeCountFloat: proto.Float64(1.5)},
+			}},
+			want: map[string]float64{"h_bucket{1}": 1.5, "h_bucket{+Inf}": 2.5, "h_sum": 1, "h_count": 2.5},
+		},
+		{
+			name:  "gauge histogram",
+			h:     &io_prometheus_client.Histogram{SampleCount: proto.Uint64(3), SampleSum: proto.Float64(17), Bucket: classicBuckets([]float64{10}, []uint64{2})},
+			gauge: true,
+			want:  map[string]float64{"h_bucket{10}": 2, "h_bucket{+Inf}": 3, "h_gsum": 17, "h_gcount": 3},
+		},
+		{
+			name: "native drops classic buckets",
+			h:    native(&io_prometheus_client.Histogram{SampleCount: proto.Uint64(3), SampleSum: proto.Float64(5), Bucket: classicBuckets([]float64{1}, []uint64{1})}),
+			want: map[string]float64{"h[native]": 5},
+		},
+		{
+			name:    "native keeps classic buckets when asked",
+			h:       native(&io_prometheus_client.Histogram{SampleCount: proto.Uint64(3), SampleSum: proto.Float64(5), Bucket: classicBuckets([]float64{1}, []uint64{1})}),
+			classic: true,
+			want:    map[string]float64{"h[native]": 5, "h_bucket{1}": 1, "h_bucket{+Inf}": 3, "h_sum": 5, "h_count": 3},
+		},
+		{
+			name:    "native without classic buckets",
+			h:       native(&io_prometheus_client.Histogram{SampleCount: proto.Uint64(3), SampleSum: proto.Float64(5)}),
+			classic: true,
+			want:    map[string]float64{"h[native]": 5},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := newLabelBuilder(nil, []prompb.Label{{Name: "job", Value: "test"}})
+			timeseries := convertHistogram("h", b, tc.h, tc.gauge, tc.classic, 1000)
+
+			got := histogramSeries(t, timeseries)
+			if len(got) != len(tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+			for name, want := range tc.want {
+				if v, ok := got[name]; !ok || v != want {
+					t.Errorf("%s: got %v (present %v), want %v", name, v, ok, want)
+				}
+			}
+			for _, ts := range timeseries {
+				if labelValue(ts.Labels, "job") != "test" {
+					t.Errorf("target labels not added: %v", ts.Labels)
+				}
+			}
+		})
+	}
+}
+
+func TestNativeHistogram(t *testing.T) {
+	h := &io_prometheus_client.Histogram{
+		SampleCount:   proto.Uint64(5),
+		SampleSum:     proto.Float64(7),
+		Schema:        proto.Int32(3),
+		ZeroThreshold: proto.Float64(0.001),
+		ZeroCount:     proto.Uint64(1),
+		PositiveSpan:  []*io_prometheus_client.BucketSpan{{Offset: proto.Int32(-1), Length: proto.Uint32(2)}},
+		PositiveDelta: []int64{2, 0},
+		NegativeSpan:  []*io_prometheus_client.BucketSpan{{Offset: proto.Int32(0), Length: proto.Uint32(1)}},
+		NegativeDelta: []int64{0},
+	}
+	if !isNativeHistogram(h) {
+		t.Fatal("histogram with spans is not native")
+	}
+
+	ph := nativeHistogram(h, false, 1000)
+	if ph.GetCountInt() != 5 || ph.GetZeroCountInt() != 1 || ph.Sum != 7 || ph.Schema != 3 || ph.Timestamp != 1000 {
+		t.Errorf("got %+v", ph)
+	}
+	if !slices.Equal(ph.PositiveDeltas, []int64{2, 0}) || len(ph.PositiveSpans) != 1 || ph.PositiveSpans[0].Offset != -1 {
+		t.Errorf("got positive buckets %v %v", ph.PositiveSpans, ph.PositiveDeltas)
+	}
+	if ph.ResetHint != prompb.Histogram_UNKNOWN {
+		t.Errorf("got reset hint %v, want UNKNOWN", ph.ResetHint)
+	}
+	if gauge := nativeHistogram(h, true, 1000); gauge.ResetHint != prompb.Histogram_GAUGE {
+		t.Errorf("got reset hint %v for a gauge histogram, want GAUGE", gauge.ResetHint)
+	}
+
+	h.SampleCountFloat = proto.Float64(4.5)
+	h.ZeroCountFloat = proto.Float64(0.5)
+	h.PositiveCount = []float64{2, 2}
+	ph = nativeHistogram(h, false, 1000)
+	if ph.GetCountFloat() != 4.5 || ph.GetZeroCountFloat() != 0.5 || ph.PositiveDeltas != nil || !slices.Equal(ph.PositiveCounts, []float64{2, 2}) {
+		t.Errorf("got float histogram %+v", ph)
+	}
+
+	if isNativeHistogram(&io_prometheus_client.Histogram{Bucket: classicBuckets([]float64{1}, []uint64{1})}) {
+		t.Error("classic histogram is native")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	config_util "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+const (
+	httpSDURLLabel = model.MetaLabelPrefix + "url"
+
+	defaultHTTPSDRefreshInterval = 60 * time.Second
+)
+
+// HTTPSDConfig fetches targets from an endpoint that returns a JSON list of
+// target groups, like Prometheus' http_sd_configs
+type HTTPSDConfig struct {
+	URL             string         `yaml:"url"`
+	RefreshInterval model.Duration `yaml:"refresh_interval,omitempty"`
+
+	HTTPClientConfig config_util.HTTPClientConfig `yaml:",inline"`
+
+	client *http.Client
+}
+
+func (c *HTTPSDConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = HTTPSDConfig{HTTPClientConfig: config_util.DefaultHTTPClientConfig}
+	type plain HTTPSDConfig
+	return unmarshal((*plain)(c))
+}
+
+func (c *HTTPSDConfig) validate() error {
+	if c.URL == "" {
+		return fmt.Errorf("url is required")
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url %q: %w", c.URL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid url %q: scheme must be http or https", c.URL)
+	}
+
+	if c.RefreshInterval == 0 {
+		c.RefreshInterval = model.Duration(defaultHTTPSDRefreshInterval)
+	}
+	if c.RefreshInterval < 0 {
+		return fmt.Errorf("refresh_interval must be positive")
+	}
+
+	if err := c.HTTPClientConfig.Validate(); err != nil {
+		return err
+	}
+
+	client, err := config_util.NewClientFromConfig(c.HTTPClientConfig, "http_sd")
+	if err != nil {
+		return fmt.Errorf("failed to create client: %w", err)
+	}
+	client.Timeout = time.Duration(c.RefreshInterval)
+	c.client = client
+
+	return nil
+}
+
+func (c *HTTPSDConfig) discoverer() discoverer {
+	return &httpDiscovery{cfg: c}
+}
+
+// httpDiscovery polls the endpoint every refresh_interval
+type httpDiscovery struct {
+	cfg *HTTPSDConfig
+}
+
+func (d *httpDiscovery) run(ctx context.Context, updates chan<- []labels.Labels) {
+	pollDiscovery(ctx, time.Duration(d.cfg.RefreshInterval), "targets from "+d.cfg.URL, d.discover, updates)
+}
+
+func (d *httpDiscovery) discover(ctx context.Context) ([]labels.Labels, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.cfg.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Prometheus-Refresh-Interval-Seconds", strconv.FormatFloat(time.Duration(d.cfg.RefreshInterval).Seconds(), 'f', -1, 64))
+
+	resp, err := d.cfg.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "application/json" {
+		return nil, fmt.Errorf("unexpected Content-Type %q, want application/json", resp.Header.Get("Content-Type"))
+	}
+
+	var groups []targetGroup
+	if err := json.NewDecoder(resp.Body).Decode(&groups); err != nil {
+		return nil, fmt.Errorf("failed to decode: %w", err)
+	}
+
+	return targetGroupLabels(groups, map[string]string{httpSDURLLabel: d.cfg.URL})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// testSDEndpoint is an http_sd endpoint whose response tests can change
+type testSDEndpoint struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	status      int
+	contentType string
+	body        string
+	header      http.Header
+}
+
+func newTestSDEndpoint(t *testing.T, body string) *testSDEndpoint {
+	e := &testSDEndpoint{status: http.StatusOK, contentType: "application/json; charset=utf-8", body: body}
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		e.header = r.Header.Clone()
+		w.Header().Set("Content-Type", e.contentType)
+		w.WriteHeader(e.status)
+		w.Write([]byte(e.body))
+	}))
+	t.Cleanup(e.Close)
+	return e
+}
+
+func (e *testSDEndpoint) set(status int, contentType, body string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.status, e.contentType, e.body = status, contentType, body
+}
+
+func newTestHTTPDiscovery(t *testing.T, url string) *httpDiscovery {
+	cfg, err := loadTestConfig(t, `
+targets:
+  - job: http
+    http_sd_configs:
+      - url: `+url+`
+        refresh_interval: 30s
+`, configOverrides{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg.Targets[0].HTTPSDConfigs[0].discoverer().(*httpDiscovery)
+}
+
+func TestHTTPSDConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  HTTPSDConfig
+		err  string
+	}{
+		{"no url", HTTPSDConfig{}, "url is required"},
+		{"bad url", HTTPSDConfig{URL: "http://[::1"}, "invalid url"},
+		{"bad scheme", HTTPSDConfig{URL: "ftp://sd.example.com/targets"}, "scheme must be http or https"},
+		{"negative refresh", HTTPSDConfig{URL: "http://sd.example.com", RefreshInterval: model.Duration(-time.Second)}, "refresh_interval must be positive"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.cfg.validate(); err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("got %v, want an error containing %q", err, tc.err)
+			}
+		})
+	}
+
+	cfg := HTTPSDConfig{URL: "https://sd.example.com/targets"}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RefreshInterval != model.Duration(defaultHTTPSDRefreshInterval) || cfg.client == nil {
+		t.Errorf("got refresh_interval %v and client %v, want the default and a client", cfg.RefreshInterval, cfg.client)
+	}
+}
+
+func TestHTTPSDDiscover(t *testing.T) {
+	endpoint := newTestSDEndpoint(t, `[
+		{"targets": ["web-1:8080", "web-2:8080"], "labels": {"team": "web"}},
+		{"targets": ["db-1:9187"]}
+	]`)
+	d := newTestHTTPDiscovery(t, endpoint.URL)
+
+	lsets, err := d.discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := addresses(lsets); !slices.Equal(got, []string{"db-1:9187", "web-1:8080", "web-2:8080"}) {
+		t.Fatalf("got targets %v", got)
+	}
+	for _, lset := range lsets {
+		team := "web"
+		if strings.HasPrefix(lset.Get(model.AddressLabel), "db") {
+			team = ""
+		}
+		checkLabels(t, lset, map[string]string{"team": team, httpSDURLLabel: endpoint.URL})
+	}
+
+	endpoint.mu.Lock()
+	accept, refresh := endpoint.header.Get("Accept"), endpoint.header.Get("X-Prometheus-Refresh-Interval-Seconds")
+	endpoint.mu.Unlock()
+	if accept != "application/json" || refresh != "30" {
+		t.Errorf("got Accept %q and refresh interval %q, want application/json and 30", accept, refresh)
+	}
+}
+
+func TestHTTPSDErrors(t *testing.T) {
+	endpoint := newTestSDEndpoint(t, "")
+	d := newTestHTTPDiscovery(t, endpoint.URL)
+
+	for _, tc := range []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		err         string
+	}{
+		{"status", http.StatusServiceUnavailable, "application/json", `[]`, "unexpected status code: 503"},
+		{"content type", http.StatusOK, "text/plain", `[]`, "unexpected Content-Type"},
+		{"bad json", http.StatusOK, "application/json", `[{"targets": [`, "failed to decode"},
+		{"empty target", http.StatusOK, "application/json", `[{"targets": [""]}]`, "empty target"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			endpoint.set(tc.status, tc.contentType, tc.body)
+			if _, err := d.discover(context.Background()); err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("got %v, want an error containing %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestHTTPSDKeepsTargetsOnError(t *testing.T) {
+	endpoint := newTestSDEndpoint(t, `[{"targets": ["web-1:8080"]}]`)
+	cfg := &HTTPSDConfig{URL: endpoint.URL, RefreshInterval: model.Duration(10 * time.Millisecond)}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan []labels.Labels)
+	go cfg.discoverer().run(ctx, updates)
+
+	if got := addresses(<-updates); !slices.Equal(got, []string{"web-1:8080"}) {
+		t.Fatalf("got targets %v", got)
+	}
+
+	// A failing endpoint sends no update, so the last targets stay in effect
+	endpoint.set(http.StatusInternalServerError, "application/json", "")
+	select {
+	case lsets := <-updates:
+		t.Fatalf("got update %v from a failing endpoint", lsets)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	endpoint.set(http.StatusOK, "application/json", `[{"targets": ["web-2:8080"]}]`)
+	if got := addresses(<-updates); !slices.Equal(got, []string{"web-2:8080"}) {
+		t.Errorf("got targets %v after the endpoint recovered", got)
+	}
+}
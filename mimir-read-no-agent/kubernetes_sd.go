@@ -0,0 +1,551 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	config_util "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/util/strutil"
+)
+
+const (
+	kubernetesRolePod       = "pod"
+	kubernetesRoleService   = "service"
+	kubernetesRoleEndpoints = "endpoints"
+
+	serviceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	serviceAccountCAPath    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+
+	kubernetesMetaPrefix = model.MetaLabelPrefix + "kubernetes_"
+
+	defaultKubernetesRefreshInterval = 30 * time.Second
+)
+
+// KubernetesSDConfig discovers targets by listing pods, services or
+// endpoints from the Kubernetes API server, with the same __meta_kubernetes_*
+// labels as Prometheus' kubernetes_sd_configs
+type KubernetesSDConfig struct {
+	Role string `yaml:"role"`
+	// APIServer defaults to the in-cluster API server, authenticated with the pod's service account
+	APIServer       string         `yaml:"api_server,omitempty"`
+	Namespaces      []string       `yaml:"namespaces,omitempty"`
+	LabelSelector   string         `yaml:"label_selector,omitempty"`
+	RefreshInterval model.Duration `yaml:"refresh_interval,omitempty"`
+
+	// Annotations scrapes only objects annotated prometheus.io/scrape: "true",
+	// honoring prometheus.io/path, prometheus.io/port and prometheus.io/scheme.
+	// Defaults to true; set it to false to select targets with relabel_configs instead.
+	Annotations *bool `yaml:"annotations,omitempty"`
+
+	HTTPClientConfig config_util.HTTPClientConfig `yaml:",inline"`
+
+	client *http.Client
+}
+
+func (c *KubernetesSDConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = KubernetesSDConfig{HTTPClientConfig: config_util.DefaultHTTPClientConfig}
+	type plain KubernetesSDConfig
+	return unmarshal((*plain)(c))
+}
+
+func (c *KubernetesSDConfig) validate() error {
+	switch c.Role {
+	case kubernetesRolePod, kubernetesRoleService, kubernetesRoleEndpoints:
+	default:
+		return fmt.Errorf("role must be %q, %q or %q", kubernetesRolePod, kubernetesRoleService, kubernetesRoleEndpoints)
+	}
+
+	if c.RefreshInterval == 0 {
+		c.RefreshInterval = model.Duration(defaultKubernetesRefreshInterval)
+	}
+	if c.RefreshInterval < 0 {
+		return fmt.Errorf("refresh_interval must be positive")
+	}
+
+	if c.Annotations == nil {
+		annotations := true
+		c.Annotations = &annotations
+	}
+
+	if c.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return fmt.Errorf("api_server is required when not running in a Kubernetes cluster")
+		}
+		c.APIServer = "https://" + net.JoinHostPort(host, port)
+
+		// Use the pod's service account unless other credentials were configured
+		if c.HTTPClientConfig.Authorization == nil && c.HTTPClientConfig.BasicAuth == nil && c.HTTPClientConfig.BearerToken == "" && c.HTTPClientConfig.BearerTokenFile == "" {
+			c.HTTPClientConfig.Authorization = &config_util.Authorization{Type: "Bearer", CredentialsFile: serviceAccountTokenPath}
+		}
+		if c.HTTPClientConfig.TLSConfig.CAFile == "" && c.HTTPClientConfig.TLSConfig.CA == "" {
+			c.HTTPClientConfig.TLSConfig.CAFile = serviceAccountCAPath
+		}
+	}
+
+	u, err := url.Parse(c.APIServer)
+	if err != nil {
+		return fmt.Errorf("invalid api_server %q: %w", c.APIServer, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid api_server %q: scheme must be http or https", c.APIServer)
+	}
+
+	if err := c.HTTPClientConfig.Validate(); err != nil {
+		return err
+	}
+
+	client, err := config_util.NewClientFromConfig(c.HTTPClientConfig, "kubernetes_sd")
+	if err != nil {
+		return fmt.Errorf("failed to create client: %w", err)
+	}
+	client.Timeout = time.Duration(c.RefreshInterval)
+	c.client = client
+
+	return nil
+}
+
+func (c *KubernetesSDConfig) discoverer() discoverer {
+	return &kubernetesDiscovery{cfg: c}
+}
+
+// kubernetesDiscovery polls the API server every refresh_interval
+type kubernetesDiscovery struct {
+	cfg *KubernetesSDConfig
+}
+
+func (d *kubernetesDiscovery) run(ctx context.Context, updates chan<- []labels.Labels) {
+	source := fmt.Sprintf("Kubernetes %s targets from %s", d.cfg.Role, d.cfg.APIServer)
+	pollDiscovery(ctx, time.Duration(d.cfg.RefreshInterval), source, d.discover, updates)
+}
+
+func (d *kubernetesDiscovery) discover(ctx context.Context) ([]labels.Labels, error) {
+	switch d.cfg.Role {
+	case kubernetesRolePod:
+		pods, err := kubernetesList[k8sPod](ctx, d, "pods", d.cfg.LabelSelector)
+		if err != nil {
+			return nil, err
+		}
+		var lsets []labels.Labels
+		for _, pod := range pods {
+			lsets = append(lsets, d.podTargets(pod)...)
+		}
+		return lsets, nil
+
+	case kubernetesRoleService:
+		services, err := kubernetesList[k8sService](ctx, d, "services", d.cfg.LabelSelector)
+		if err != nil {
+			return nil, err
+		}
+		var lsets []labels.Labels
+		for _, svc := range services {
+			lsets = append(lsets, d.serviceTargets(svc)...)
+		}
+		return lsets, nil
+
+	default:
+		endpoints, err := kubernetesList[k8sEndpoints](ctx, d, "endpoints", d.cfg.LabelSelector)
+		if err != nil {
+			return nil, err
+		}
+		services, err := kubernetesList[k8sService](ctx, d, "services", "")
+		if err != nil {
+			return nil, err
+		}
+		pods, err := kubernetesList[k8sPod](ctx, d, "pods", "")
+		if err != nil {
+			return nil, err
+		}
+
+		servicesByName := make(map[string]k8sService, len(services))
+		for _, svc := range services {
+			servicesByName[svc.Metadata.Namespace+"/"+svc.Metadata.Name] = svc
+		}
+		podsByName := make(map[string]k8sPod, len(pods))
+		for _, pod := range pods {
+			podsByName[pod.Metadata.Namespace+"/"+pod.Metadata.Name] = pod
+		}
+
+		var lsets []labels.Labels
+		for _, ep := range endpoints {
+			lsets = append(lsets, d.endpointsTargets(ep, servicesByName, podsByName)...)
+		}
+		return lsets, nil
+	}
+}
+
+// kubernetesList lists a resource in the configured namespaces, or in all of them
+func kubernetesList[T any](ctx context.Context, d *kubernetesDiscovery, resource, selector string) ([]T, error) {
+	paths := []string{"/api/v1/" + resource}
+	if len(d.cfg.Namespaces) > 0 {
+		paths = paths[:0]
+		for _, ns := range d.cfg.Namespaces {
+			paths = append(paths, "/api/v1/namespaces/"+url.PathEscape(ns)+"/"+resource)
+		}
+	}
+
+	var items []T
+	for _, path := range paths {
+		u := d.cfg.APIServer + path
+		if selector != "" {
+			u += "?labelSelector=" + url.QueryEscape(selector)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Accept", "application/json")
+
+		resp, err := d.cfg.client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", resource, err)
+		}
+
+		var list struct {
+			Items []T `json:"items"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to list %s: unexpected status code: %d", resource, resp.StatusCode)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", resource, err)
+		}
+
+		items = append(items, list.Items...)
+	}
+
+	return items, nil
+}
+
+// podTargets returns a target per container port of a running pod, or one
+// per container without ports
+func (d *kubernetesDiscovery) podTargets(pod k8sPod) []labels.Labels {
+	if pod.Status.PodIP == "" || pod.Status.Phase == "Succeeded" || pod.Status.Phase == "Failed" {
+		return nil
+	}
+
+	scrape, path, scheme, port := d.annotations("pod", pod.Metadata)
+	if !scrape {
+		return nil
+	}
+
+	var lsets []labels.Labels
+	for _, c := range pod.Spec.Containers {
+		if len(c.Ports) == 0 && port == "" {
+			b := d.podLabels(pod)
+			b.Set(model.AddressLabel, pod.Status.PodIP)
+			setContainerLabels(b, c, nil)
+			setScrapeLabels(b, path, scheme)
+			lsets = append(lsets, b.Labels())
+			continue
+		}
+
+		for _, p := range c.Ports {
+			// With a prometheus.io/port annotation only that port is scraped
+			if port != "" && strconv.Itoa(int(p.ContainerPort)) != port {
+				continue
+			}
+
+			b := d.podLabels(pod)
+			b.Set(model.AddressLabel, net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(int(p.ContainerPort))))
+			setContainerLabels(b, c, &p)
+			setScrapeLabels(b, path, scheme)
+			lsets = append(lsets, b.Labels())
+		}
+	}
+
+	// The annotated port is not declared by any container
+	if port != "" && len(lsets) == 0 {
+		b := d.podLabels(pod)
+		b.Set(model.AddressLabel, net.JoinHostPort(pod.Status.PodIP, port))
+		setScrapeLabels(b, path, scheme)
+		lsets = append(lsets, b.Labels())
+	}
+
+	return lsets
+}
+
+func (d *kubernetesDiscovery) podLabels(pod k8sPod) *labels.Builder {
+	b := labels.NewBuilder(labels.EmptyLabels())
+	b.Set(kubernetesMetaPrefix+"namespace", pod.Metadata.Namespace)
+	setPodLabels(b, pod)
+	return b
+}
+
+// serviceTargets returns a target per service port, addressed by the service's DNS name
+func (d *kubernetesDiscovery) serviceTargets(svc k8sService) []labels.Labels {
+	scrape, path, scheme, port := d.annotations("service", svc.Metadata)
+	if !scrape {
+		return nil
+	}
+
+	var lsets []labels.Labels
+	for _, p := range svc.Spec.Ports {
+		if port != "" && strconv.Itoa(int(p.Port)) != port {
+			continue
+		}
+
+		host := svc.Metadata.Name + "." + svc.Metadata.Namespace + ".svc"
+		b := labels.NewBuilder(labels.EmptyLabels())
+		b.Set(model.AddressLabel, net.JoinHostPort(host, strconv.Itoa(int(p.Port))))
+		b.Set(kubernetesMetaPrefix+"namespace", svc.Metadata.Namespace)
+		setServiceLabels(b, svc)
+		b.Set(kubernetesMetaPrefix+"service_port_name", p.Name)
+		b.Set(kubernetesMetaPrefix+"service_port_number", strconv.Itoa(int(p.Port)))
+		b.Set(kubernetesMetaPrefix+"service_port_protocol", p.Protocol)
+		setScrapeLabels(b, path, scheme)
+		lsets = append(lsets, b.Labels())
+	}
+
+	return lsets
+}
+
+// endpointsTargets returns a target per address and port of an endpoints
+// object, with the labels of its service and of the pod behind each address.
+// The service's annotations decide what is scraped.
+func (d *kubernetesDiscovery) endpointsTargets(ep k8sEndpoints, services map[string]k8sService, pods map[string]k8sPod) []labels.Labels {
+	svc, hasService := services[ep.Metadata.Namespace+"/"+ep.Metadata.Name]
+
+	scrape, path, scheme, port := d.annotations("service", svc.Metadata)
+	if !scrape {
+		return nil
+	}
+
+	var lsets []labels.Labels
+	for _, subset := range ep.Subsets {
+		addresses := make([]k8sEndpointAddress, 0, len(subset.Addresses)+len(subset.NotReadyAddresses))
+		addresses = append(addresses, subset.Addresses...)
+		addresses = append(addresses, subset.NotReadyAddresses...)
+
+		for i, addr := range addresses {
+			ready := i < len(subset.Addresses)
+
+			ports := subset.Ports
+			if port != "" {
+				// annotations already checked it is a port number
+				n, _ := strconv.Atoi(port)
+				ports = []k8sPort{{Port: int32(n)}}
+				for _, p := range subset.Ports {
+					if p.Port == int32(n) {
+						ports = []k8sPort{p}
+					}
+				}
+			}
+
+			for _, p := range ports {
+				b := labels.NewBuilder(labels.EmptyLabels())
+				b.Set(model.AddressLabel, net.JoinHostPort(addr.IP, strconv.Itoa(int(p.Port))))
+				b.Set(kubernetesMetaPrefix+"namespace", ep.Metadata.Namespace)
+				b.Set(kubernetesMetaPrefix+"endpoints_name", ep.Metadata.Name)
+				setObjectLabels(b, "endpoints", ep.Metadata)
+				b.Set(kubernetesMetaPrefix+"endpoint_ready", strconv.FormatBool(ready))
+				b.Set(kubernetesMetaPrefix+"endpoint_port_name", p.Name)
+				b.Set(kubernetesMetaPrefix+"endpoint_port_protocol", p.Protocol)
+				b.Set(kubernetesMetaPrefix+"endpoint_hostname", addr.Hostname)
+				if addr.NodeName != nil {
+					b.Set(kubernetesMetaPrefix+"endpoint_node_name", *addr.NodeName)
+				}
+				if ref := addr.TargetRef; ref != nil {
+					b.Set(kubernetesMetaPrefix+"endpoint_address_target_kind", ref.Kind)
+					b.Set(kubernetesMetaPrefix+"endpoint_address_target_name", ref.Name)
+					if pod, ok := pods[ep.Metadata.Namespace+"/"+ref.Name]; ok && ref.Kind == "Pod" {
+						setPodLabels(b, pod)
+					}
+				}
+				if hasService {
+					setServiceLabels(b, svc)
+				}
+				setScrapeLabels(b, path, scheme)
+				lsets = append(lsets, b.Labels())
+			}
+		}
+	}
+
+	return lsets
+}
+
+// annotations reads the prometheus.io annotations of an object. scrape is
+// always true when annotations are disabled. An object whose port annotation
+// is not a port number is skipped.
+func (d *kubernetesDiscovery) annotations(kind string, meta k8sObjectMeta) (scrape bool, path, scheme, port string) {
+	if !*d.cfg.Annotations {
+		return true, "", "", ""
+	}
+	a := meta.Annotations
+	if a["prometheus.io/scrape"] != "true" {
+		return false, "", "", ""
+	}
+
+	port = a["prometheus.io/port"]
+	if port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			log.Printf("Skipping Kubernetes %s %s/%s: invalid prometheus.io/port annotation %q\n", kind, meta.Namespace, meta.Name, port)
+			return false, "", "", ""
+		}
+		port = strconv.Itoa(n)
+	}
+
+	return true, a["prometheus.io/path"], a["prometheus.io/scheme"], port
+}
+
+func setScrapeLabels(b *labels.Builder, path, scheme string) {
+	if path != "" {
+		b.Set(model.MetricsPathLabel, path)
+	}
+	if scheme != "" {
+		b.Set(model.SchemeLabel, scheme)
+	}
+}
+
+func setPodLabels(b *labels.Builder, pod k8sPod) {
+	b.Set(kubernetesMetaPrefix+"pod_name", pod.Metadata.Name)
+	b.Set(kubernetesMetaPrefix+"pod_ip", pod.Status.PodIP)
+	b.Set(kubernetesMetaPrefix+"pod_uid", pod.Metadata.UID)
+	b.Set(kubernetesMetaPrefix+"pod_node_name", pod.Spec.NodeName)
+	b.Set(kubernetesMetaPrefix+"pod_host_ip", pod.Status.HostIP)
+	b.Set(kubernetesMetaPrefix+"pod_phase", pod.Status.Phase)
+	b.Set(kubernetesMetaPrefix+"pod_ready", strconv.FormatBool(pod.ready()))
+	for _, ref := range pod.Metadata.OwnerReferences {
+		if ref.Controller != nil && *ref.Controller {
+			b.Set(kubernetesMetaPrefix+"pod_controller_kind", ref.Kind)
+			b.Set(kubernetesMetaPrefix+"pod_controller_name", ref.Name)
+		}
+	}
+	setObjectLabels(b, "pod", pod.Metadata)
+}
+
+func setContainerLabels(b *labels.Builder, c k8sContainer, p *k8sContainerPort) {
+	b.Set(kubernetesMetaPrefix+"pod_container_name", c.Name)
+	b.Set(kubernetesMetaPrefix+"pod_container_image", c.Image)
+	if p != nil {
+		b.Set(kubernetesMetaPrefix+"pod_container_port_name", p.Name)
+		b.Set(kubernetesMetaPrefix+"pod_container_port_number", strconv.Itoa(int(p.ContainerPort)))
+		b.Set(kubernetesMetaPrefix+"pod_container_port_protocol", p.Protocol)
+	}
+}
+
+func setServiceLabels(b *labels.Builder, svc k8sService) {
+	b.Set(kubernetesMetaPrefix+"service_name", svc.Metadata.Name)
+	b.Set(kubernetesMetaPrefix+"service_type", svc.Spec.Type)
+	b.Set(kubernetesMetaPrefix+"service_cluster_ip", svc.Spec.ClusterIP)
+	setObjectLabels(b, "service", svc.Metadata)
+}
+
+// setObjectLabels adds the Kubernetes labels and annotations of an object
+// with their names sanitized, e.g. app.kubernetes.io/name becomes
+// __meta_kubernetes_pod_label_app_kubernetes_io_name
+func setObjectLabels(b *labels.Builder, kind string, meta k8sObjectMeta) {
+	for name, value := range meta.Labels {
+		name = strutil.SanitizeLabelName(name)
+		b.Set(kubernetesMetaPrefix+kind+"_label_"+name, value)
+		b.Set(kubernetesMetaPrefix+kind+"_labelpresent_"+name, "true")
+	}
+	for name, value := range meta.Annotations {
+		name = strutil.SanitizeLabelName(name)
+		b.Set(kubernetesMetaPrefix+kind+"_annotation_"+name, value)
+		b.Set(kubernetesMetaPrefix+kind+"_annotationpresent_"+name, "true")
+	}
+}
+
+// The subset of the Kubernetes API objects the discovery reads
+
+type k8sObjectMeta struct {
+	Name            string              `json:"name"`
+	Namespace       string              `json:"namespace"`
+	UID             string              `json:"uid"`
+	Labels          map[string]string   `json:"labels"`
+	Annotations     map[string]string   `json:"annotations"`
+	OwnerReferences []k8sOwnerReference `json:"ownerReferences"`
+}
+
+type k8sOwnerReference struct {
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	Controller *bool  `json:"controller"`
+}
+
+type k8sPod struct {
+	Metadata k8sObjectMeta `json:"metadata"`
+	Spec     struct {
+		NodeName   string         `json:"nodeName"`
+		Containers []k8sContainer `json:"containers"`
+	} `json:"spec"`
+	Status struct {
+		Phase      string `json:"phase"`
+		PodIP      string `json:"podIP"`
+		HostIP     string `json:"hostIP"`
+		Conditions []struct {
+			Type   string `json:"type"`
+			Status string `json:"status"`
+		} `json:"conditions"`
+	} `json:"status"`
+}
+
+func (p k8sPod) ready() bool {
+	for _, c := range p.Status.Conditions {
+		if c.Type == "Ready" {
+			return c.Status == "True"
+		}
+	}
+	return false
+}
+
+type k8sContainer struct {
+	Name  string             `json:"name"`
+	Image string             `json:"image"`
+	Ports []k8sContainerPort `json:"ports"`
+}
+
+type k8sContainerPort struct {
+	Name          string `json:"name"`
+	ContainerPort int32  `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+}
+
+type k8sService struct {
+	Metadata k8sObjectMeta `json:"metadata"`
+	Spec     struct {
+		Type      string    `json:"type"`
+		ClusterIP string    `json:"clusterIP"`
+		Ports     []k8sPort `json:"ports"`
+	} `json:"spec"`
+}
+
+type k8sPort struct {
+	Name     string `json:"name"`
+	Port     int32  `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
+type k8sEndpoints struct {
+	Metadata k8sObjectMeta `json:"metadata"`
+	Subsets  []struct {
+		Addresses         []k8sEndpointAddress `json:"addresses"`
+		NotReadyAddresses []k8sEndpointAddress `json:"notReadyAddresses"`
+		Ports             []k8sPort            `json:"ports"`
+	} `json:"subsets"`
+}
+
+type k8sEndpointAddress struct {
+	IP        string  `json:"ip"`
+	Hostname  string  `json:"hostname"`
+	NodeName  *string `json:"nodeName"`
+	TargetRef *struct {
+		Kind string `json:"kind"`
+		Name string `json:"name"`
+	} `json:"targetRef"`
+}
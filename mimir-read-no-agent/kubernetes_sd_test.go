@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	config_util "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// fakeKubernetesAPI serves canned list responses by request path
+type fakeKubernetesAPI struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	lists     map[string]string
+	selectors map[string]string
+}
+
+func newFakeKubernetesAPI(t *testing.T) *fakeKubernetesAPI {
+	api := &fakeKubernetesAPI{lists: make(map[string]string), selectors: make(map[string]string)}
+	api.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api.mu.Lock()
+		defer api.mu.Unlock()
+
+		api.selectors[r.URL.Path] = r.URL.Query().Get("labelSelector")
+		list, ok := api.lists[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(list))
+	}))
+	t.Cleanup(api.Close)
+	return api
+}
+
+func (api *fakeKubernetesAPI) set(path, list string) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.lists[path] = list
+}
+
+func (api *fakeKubernetesAPI) selector(path string) string {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return api.selectors[path]
+}
+
+func newTestKubernetesDiscovery(t *testing.T, cfg KubernetesSDConfig) *kubernetesDiscovery {
+	cfg.HTTPClientConfig = config_util.DefaultHTTPClientConfig
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	return &kubernetesDiscovery{cfg: &cfg}
+}
+
+// checkLabels fails unless every label in want is set to its value, an
+// empty value meaning the label must be absent
+func checkLabels(t *testing.T, got labels.Labels, want map[string]string) {
+	t.Helper()
+	for name, value := range want {
+		if got.Get(name) != value {
+			t.Errorf("%s = %q, want %q in %v", name, got.Get(name), value, got)
+		}
+	}
+}
+
+const testPods = `{"items": [
+	{
+		"metadata": {
+			"name": "web-1", "namespace": "default", "uid": "uid-1",
+			"labels": {"app.kubernetes.io/name": "web"},
+			"annotations": {
+				"prometheus.io/scrape": "true",
+				"prometheus.io/path": "/custom",
+				"prometheus.io/port": "8080",
+				"prometheus.io/scheme": "https"
+			},
+			"ownerReferences": [{"kind": "ReplicaSet", "name": "web-abc", "controller": true}]
+		},
+		"spec": {
+			"nodeName": "node-1",
+			"containers": [{
+				"name": "app", "image": "web:1",
+				"ports": [
+					{"name": "http", "containerPort": 8080, "protocol": "TCP"},
+					{"name": "admin", "containerPort": 9090, "protocol": "TCP"}
+				]
+			}]
+		},
+		"status": {
+			"phase": "Running", "podIP": "10.0.0.1", "hostIP": "192.168.0.1",
+			"conditions": [{"type": "Ready", "status": "True"}]
+		}
+	},
+	{
+		"metadata": {"name": "unannotated", "namespace": "default"},
+		"spec": {"containers": [{"name": "app", "ports": [{"containerPort": 80}]}]},
+		"status": {"phase": "Running", "podIP": "10.0.0.2"}
+	},
+	{
+		"metadata": {"name": "job-1", "namespace": "default", "annotations": {"prometheus.io/scrape": "true"}},
+		"spec": {"containers": [{"name": "job", "ports": [{"containerPort": 80}]}]},
+		"status": {"phase": "Succeeded", "podIP": "10.0.0.3"}
+	}
+]}`
+
+func TestKubernetesSDPods(t *testing.T) {
+	api := newFakeKubernetesAPI(t)
+	api.set("/api/v1/namespaces/default/pods", testPods)
+
+	d := newTestKubernetesDiscovery(t, KubernetesSDConfig{
+		Role:          kubernetesRolePod,
+		APIServer:     api.URL,
+		Namespaces:    []string{"default"},
+		LabelSelector: "app.kubernetes.io/name=web",
+	})
+	lsets, err := d.discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := api.selector("/api/v1/namespaces/default/pods"); got != "app.kubernetes.io/name=web" {
+		t.Errorf("got label selector %q", got)
+	}
+
+	// Only the annotated port of the running, annotated pod
+	if len(lsets) != 1 {
+		t.Fatalf("got %d targets, want 1: %v", len(lsets), lsets)
+	}
+	checkLabels(t, lsets[0], map[string]string{
+		model.AddressLabel:     "10.0.0.1:8080",
+		model.MetricsPathLabel: "/custom",
+		model.SchemeLabel:      "https",
+
+		"__meta_kubernetes_namespace":                                "default",
+		"__meta_kubernetes_pod_name":                                 "web-1",
+		"__meta_kubernetes_pod_uid":                                  "uid-1",
+		"__meta_kubernetes_pod_ip":                                   "10.0.0.1",
+		"__meta_kubernetes_pod_host_ip":                              "192.168.0.1",
+		"__meta_kubernetes_pod_node_name":                            "node-1",
+		"__meta_kubernetes_pod_phase":                                "Running",
+		"__meta_kubernetes_pod_ready":                                "true",
+		"__meta_kubernetes_pod_controller_kind":                      "ReplicaSet",
+		"__meta_kubernetes_pod_controller_name":                      "web-abc",
+		"__meta_kubernetes_pod_container_name":                       "app",
+		"__meta_kubernetes_pod_container_image":                      "web:1",
+		"__meta_kubernetes_pod_container_port_name":                  "http",
+		"__meta_kubernetes_pod_container_port_number":                "8080",
+		"__meta_kubernetes_pod_container_port_protocol":              "TCP",
+		"__meta_kubernetes_pod_label_app_kubernetes_io_name":         "web",
+		"__meta_kubernetes_pod_labelpresent_app_kubernetes_io_name":  "true",
+		"__meta_kubernetes_pod_annotation_prometheus_io_path":        "/custom",
+		"__meta_kubernetes_pod_annotationpresent_prometheus_io_path": "true",
+	})
+
+	target, err := (&TargetConfig{Job: "kubernetes-pods"}).discoveredTarget(lsets[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.scrapeURL != "https://10.0.0.1:8080/custom" {
+		t.Errorf("got scrape url %q", target.scrapeURL)
+	}
+}
+
+func TestKubernetesSDPodsWithoutAnnotations(t *testing.T) {
+	api := newFakeKubernetesAPI(t)
+	api.set("/api/v1/pods", testPods)
+
+	annotations := false
+	d := newTestKubernetesDiscovery(t, KubernetesSDConfig{Role: kubernetesRolePod, APIServer: api.URL, Annotations: &annotations})
+	lsets, err := d.discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every container port of the running pods, annotated or not
+	var addresses []string
+	for _, lbls := range lsets {
+		addresses = append(addresses, lbls.Get(model.AddressLabel))
+		checkLabels(t, lbls, map[string]string{model.MetricsPathLabel: "", model.SchemeLabel: ""})
+	}
+	want := []string{"10.0.0.1:8080", "10.0.0.1:9090", "10.0.0.2:80"}
+	if len(addresses) != len(want) {
+		t.Fatalf("got targets %v, want %v", addresses, want)
+	}
+	for i := range want {
+		if addresses[i] != want[i] {
+			t.Errorf("got targets %v, want %v", addresses, want)
+			break
+		}
+	}
+}
+
+const testServices = `{"items": [
+	{
+		"metadata": {
+			"name": "web", "namespace": "default",
+			"labels": {"team": "platform"},
+			"annotations": {"prometheus.io/scrape": "true", "prometheus.io/port": "9100", "prometheus.io/path": "/stats"}
+		},
+		"spec": {
+			"type": "ClusterIP", "clusterIP": "10.96.0.10",
+			"ports": [
+				{"name": "http", "port": 80, "protocol": "TCP"},
+				{"name": "metrics", "port": 9100, "protocol": "TCP"}
+			]
+		}
+	},
+	{
+		"metadata": {"name": "db", "namespace": "default"},
+		"spec": {"type": "ClusterIP", "ports": [{"name": "sql", "port": 5432}]}
+	}
+]}`
+
+func TestKubernetesSDServices(t *testing.T) {
+	api := newFakeKubernetesAPI(t)
+	api.set("/api/v1/services", testServices)
+
+	d := newTestKubernetesDiscovery(t, KubernetesSDConfig{Role: kubernetesRoleService, APIServer: api.URL})
+	lsets, err := d.discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(lsets) != 1 {
+		t.Fatalf("got %d targets, want 1: %v", len(lsets), lsets)
+	}
+	checkLabels(t, lsets[0], map[string]string{
+		model.AddressLabel:     "web.default.svc:9100",
+		model.MetricsPathLabel: "/stats",
+		model.SchemeLabel:      "",
+
+		"__meta_kubernetes_namespace":                             "default",
+		"__meta_kubernetes_service_name":                          "web",
+		"__meta_kubernetes_service_type":                          "ClusterIP",
+		"__meta_kubernetes_service_cluster_ip":                    "10.96.0.10",
+		"__meta_kubernetes_service_port_name":                     "metrics",
+		"__meta_kubernetes_service_port_number":                   "9100",
+		"__meta_kubernetes_service_port_protocol":                 "TCP",
+		"__meta_kubernetes_service_label_team":                    "platform",
+		"__meta_kubernetes_service_labelpresent_team":             "true",
+		"__meta_kubernetes_service_annotation_prometheus_io_port": "9100",
+	})
+}
+
+const testEndpoints = `{"items": [
+	{
+		"metadata": {"name": "web", "namespace": "default", "labels": {"team": "platform"}},
+		"subsets": [{
+			"addresses": [{"ip": "10.0.0.1", "nodeName": "node-1", "targetRef": {"kind": "Pod", "name": "web-1"}}],
+			"notReadyAddresses": [{"ip": "10.0.0.4", "hostname": "web-2"}],
+			"ports": [
+				{"name": "http", "port": 8080, "protocol": "TCP"},
+				{"name": "metrics", "port": 9100, "protocol": "TCP"}
+			]
+		}]
+	},
+	{
+		"metadata": {"name": "db", "namespace": "default"},
+		"subsets": [{"addresses": [{"ip": "10.0.0.5"}], "ports": [{"name": "sql", "port": 5432}]}]
+	}
+]}`
+
+func TestKubernetesSDEndpoints(t *testing.T) {
+	api := newFakeKubernetesAPI(t)
+	api.set("/api/v1/endpoints", testEndpoints)
+	api.set("/api/v1/services", testServices)
+	api.set("/api/v1/pods", testPods)
+
+	d := newTestKubernetesDiscovery(t, KubernetesSDConfig{Role: kubernetesRoleEndpoints, APIServer: api.URL})
+	lsets, err := d.discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The service's annotations pick port 9100 of the web endpoints
+	if len(lsets) != 2 {
+		t.Fatalf("got %d targets, want 2: %v", len(lsets), lsets)
+	}
+	checkLabels(t, lsets[0], map[string]string{
+		model.AddressLabel:     "10.0.0.1:9100",
+		model.MetricsPathLabel: "/stats",
+
+		"__meta_kubernetes_namespace":                        "default",
+		"__meta_kubernetes_endpoints_name":                   "web",
+		"__meta_kubernetes_endpoints_label_team":             "platform",
+		"__meta_kubernetes_endpoint_ready":                   "true",
+		"__meta_kubernetes_endpoint_port_name":               "metrics",
+		"__meta_kubernetes_endpoint_port_protocol":           "TCP",
+		"__meta_kubernetes_endpoint_node_name":               "node-1",
+		"__meta_kubernetes_endpoint_address_target_kind":     "Pod",
+		"__meta_kubernetes_endpoint_address_target_name":     "web-1",
+		"__meta_kubernetes_pod_name":                         "web-1",
+		"__meta_kubernetes_pod_ip":                           "10.0.0.1",
+		"__meta_kubernetes_pod_label_app_kubernetes_io_name": "web",
+		"__meta_kubernetes_service_name":                     "web",
+		"__meta_kubernetes_service_label_team":               "platform",
+	})
+	checkLabels(t, lsets[1], map[string]string{
+		model.AddressLabel: "10.0.0.4:9100",
+
+		"__meta_kubernetes_endpoint_ready":    "false",
+		"__meta_kubernetes_endpoint_hostname": "web-2",
+		"__meta_kubernetes_pod_name":          "",
+		"__meta_kubernetes_service_name":      "web",
+	})
+}
+
+func TestKubernetesSDTargetChanges(t *testing.T) {
+	api := newFakeKubernetesAPI(t)
+	pod := func(name, ip string) string {
+		return `{"metadata": {"name": "` + name + `", "namespace": "default", "annotations": {"prometheus.io/scrape": "true"}},
+			"spec": {"containers": [{"name": "app", "ports": [{"containerPort": 80}]}]},
+			"status": {"phase": "Running", "podIP": "` + ip + `"}}`
+	}
+	api.set("/api/v1/pods", `{"items": [`+pod("a", "10.0.0.1")+`]}`)
+
+	d := newTestKubernetesDiscovery(t, KubernetesSDConfig{
+		Role:            kubernetesRolePod,
+		APIServer:       api.URL,
+		RefreshInterval: model.Duration(50 * time.Millisecond),
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan []labels.Labels)
+	go d.run(ctx, updates)
+
+	next := func(want ...string) {
+		t.Helper()
+		select {
+		case lsets := <-updates:
+			var got []string
+			for _, lbls := range lsets {
+				got = append(got, lbls.Get("__meta_kubernetes_pod_name"))
+			}
+			if len(got) != len(want) {
+				t.Fatalf("got pods %v, want %v", got, want)
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Fatalf("got pods %v, want %v", got, want)
+				}
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no update, want pods %v", want)
+		}
+	}
+
+	next("a")
+
+	api.set("/api/v1/pods", `{"items": [`+pod("a", "10.0.0.1")+`, `+pod("b", "10.0.0.2")+`]}`)
+	next("a", "b")
+
+	api.set("/api/v1/pods", `{"items": [`+pod("b", "10.0.0.2")+`]}`)
+	next("b")
+
+	api.set("/api/v1/pods", `{"items": []}`)
+	next()
+}
+
+func TestKubernetesSDListError(t *testing.T) {
+	api := newFakeKubernetesAPI(t)
+
+	d := newTestKubernetesDiscovery(t, KubernetesSDConfig{Role: kubernetesRoleService, APIServer: api.URL})
+	if _, err := d.discover(context.Background()); err == nil {
+		t.Error("discovery succeeded against an API server that lists no services")
+	}
+}
+
+func TestKubernetesSDInvalidPortAnnotation(t *testing.T) {
+	api := newFakeKubernetesAPI(t)
+	api.set("/api/v1/pods", `{"items": [
+		{
+			"metadata": {"name": "named-port", "namespace": "default", "annotations": {"prometheus.io/scrape": "true", "prometheus.io/port": "http"}},
+			"spec": {"containers": [{"name": "app", "ports": [{"name": "http", "containerPort": 8080}]}]},
+			"status": {"phase": "Running", "podIP": "10.0.0.1"}
+		},
+		{
+			"metadata": {"name": "out-of-range", "namespace": "default", "annotations": {"prometheus.io/scrape": "true", "prometheus.io/port": "70000"}},
+			"spec": {"containers": [{"name": "app"}]},
+			"status": {"phase": "Running", "podIP": "10.0.0.2"}
+		},
+		{
+			"metadata": {"name": "valid", "namespace": "default", "annotations": {"prometheus.io/scrape": "true", "prometheus.io/port": "9100"}},
+			"spec": {"containers": [{"name": "app"}]},
+			"status": {"phase": "Running", "podIP": "10.0.0.3"}
+		}
+	]}`)
+	api.set("/api/v1/services", `{"items": [{
+		"metadata": {"name": "web", "namespace": "default", "annotations": {"prometheus.io/scrape": "true", "prometheus.io/port": "metrics"}},
+		"spec": {"ports": [{"name": "metrics", "port": 9100}]}
+	}]}`)
+	api.set("/api/v1/endpoints", `{"items": [{
+		"metadata": {"name": "web", "namespace": "default"},
+		"subsets": [{"addresses": [{"ip": "10.0.0.1"}], "ports": [{"name": "metrics", "port": 9100}]}]
+	}]}`)
+
+	d := newTestKubernetesDiscovery(t, KubernetesSDConfig{Role: kubernetesRolePod, APIServer: api.URL})
+	lsets, err := d.discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lsets) != 1 || lsets[0].Get(model.AddressLabel) != "10.0.0.3:9100" {
+		t.Errorf("got pod targets %v, want only the pod with a valid port", lsets)
+	}
+
+	for _, role := range []string{kubernetesRoleService, kubernetesRoleEndpoints} {
+		d := newTestKubernetesDiscovery(t, KubernetesSDConfig{Role: role, APIServer: api.URL})
+		lsets, err := d.discover(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lsets) != 0 {
+			t.Errorf("%s role: got targets %v for a service with a named port annotation, want none", role, lsets)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// labelBuilder assembles the label sets of the series of one scraped
+// metric. Every label set is a fresh slice sorted by name, as Mimir expects,
+// so the series built from one metric (histogram buckets, summary quantiles)
+// never share a backing array.
+type labelBuilder struct {
+	base []prompb.Label
+}
+
+// newLabelBuilder starts from a metric's own labels plus the target labels.
+// As in Prometheus with honor_labels disabled, a scraped label that clashes
+// with a target label is kept under an "exported_" prefix.
+func newLabelBuilder(metricLabels []*io_prometheus_client.LabelPair, targetLabels []prompb.Label) *labelBuilder {
+	base := make([]prompb.Label, 0, len(metricLabels)+len(targetLabels))
+	for _, l := range metricLabels {
+		base = append(base, prompb.Label{Name: l.GetName(), Value: l.GetValue()})
+	}
+
+	for _, tl := range targetLabels {
+		for i := range base {
+			if base[i].Name != tl.Name {
+				continue
+			}
+			name := "exported_" + tl.Name
+			for hasLabel(base, name) {
+				name = "exported_" + name
+			}
+			base[i].Name = name
+		}
+		base = append(base, tl)
+	}
+
+	return &labelBuilder{base: base}
+}
+
+// labels returns the sorted label set of the series called name, with extra
+// labels such as le or quantile
+func (b *labelBuilder) labels(name string, extra ...prompb.Label) []prompb.Label {
+	ls := make([]prompb.Label, 0, len(b.base)+len(extra)+1)
+	ls = append(ls, prompb.Label{Name: model.MetricNameLabel, Value: name})
+	ls = append(ls, b.base...)
+	ls = append(ls, extra...)
+	sortLabels(ls)
+	return ls
+}
+
+func hasLabel(labels []prompb.Label, name string) bool {
+	for _, l := range labels {
+		if l.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func sortLabels(ls []prompb.Label) {
+	sort.SliceStable(ls, func(i, j int) bool { return ls[i].Name < ls[j].Name })
+}
+
+// Reasons a series is dropped before it is pushed, used as the reason label
+// of bridge_series_dropped_total
+const (
+	dropInvalidMetricName = "invalid_metric_name"
+	dropInvalidLabelName  = "invalid_label_name"
+	dropInvalidUTF8       = "invalid_utf8"
+	dropDuplicateLabel    = "duplicate_label_name"
+	dropDuplicateSeries   = "duplicate_series"
+	dropOutOfOrder        = "out_of_order"
+)
+
+// seriesValidator drops the series of a scrape Mimir would reject, which
+// would otherwise fail the whole write request they are batched into. It
+// remembers the last timestamp of every series to catch samples exposed
+// with timestamps that go backwards.
+type seriesValidator struct {
+	last map[uint64]int64
+}
+
+func newSeriesValidator() *seriesValidator {
+	return &seriesValidator{last: make(map[uint64]int64)}
+}
+
+// check returns the valid series and the number dropped for each reason.
+// Label sets are sorted first, since metric_relabel_configs may have
+// rewritten them.
+func (v *seriesValidator) check(series []bridgeSeries, scheme model.ValidationScheme) ([]bridgeSeries, map[string]int) {
+	dropped := make(map[string]int)
+	seen := make(map[uint64]bool, len(series))
+	last := make(map[uint64]int64, len(series))
+
+	kept := series[:0]
+	for _, s := range series {
+		sortLabels(s.Labels)
+		if reason := invalidLabels(s.Labels, scheme); reason != "" {
+			dropped[reason]++
+			continue
+		}
+
+		hash := toLabels(s.Labels).Hash()
+		if seen[hash] {
+			dropped[dropDuplicateSeries]++
+			continue
+		}
+		seen[hash] = true
+
+		// A sample the target exposes again with the same timestamp was
+		// already sent and is skipped quietly, like Prometheus does
+		ts := seriesTimestamp(s)
+		if prev, ok := v.last[hash]; ok && ts <= prev {
+			if ts < prev {
+				dropped[dropOutOfOrder]++
+			}
+			last[hash] = prev
+			continue
+		}
+		last[hash] = ts
+
+		kept = append(kept, s)
+	}
+
+	v.last = last
+	return kept, dropped
+}
+
+// invalidLabels returns why a sorted label set is invalid, or "" if it is valid
+func invalidLabels(ls []prompb.Label, scheme model.ValidationScheme) string {
+	for i, l := range ls {
+		if i > 0 && ls[i-1].Name == l.Name {
+			return dropDuplicateLabel
+		}
+		if !scheme.IsValidLabelName(l.Name) {
+			return dropInvalidLabelName
+		}
+		if !utf8.ValidString(l.Value) {
+			return dropInvalidUTF8
+		}
+		if l.Name == model.MetricNameLabel && !scheme.IsValidMetricName(l.Value) {
+			return dropInvalidMetricName
+		}
+	}
+	if !hasLabel(ls, model.MetricNameLabel) {
+		return dropInvalidMetricName
+	}
+	return ""
+}
+
+// logDropped reports the series a target's scrape lost to validation
+func logDropped(target *TargetConfig, dropped map[string]int) {
+	for reason, n := range dropped {
+		if n == 0 {
+			continue
+		}
+		log.Printf("[%s] Dropped %d series: %s\n", target, n, reason)
+		seriesDroppedTotal.WithLabelValues(target.Job, target.Instance, reason).Add(float64(n))
+	}
+}
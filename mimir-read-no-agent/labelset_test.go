@@ -0,0 +1,146 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// labelledSeries is a series at timestamp with the given label name and value pairs
+func labelledSeries(timestamp int64, pairs ...string) bridgeSeries {
+	s := testSeries("", timestamp, 1)
+	s.Labels = nil
+	for i := 0; i < len(pairs); i += 2 {
+		s.Labels = append(s.Labels, prompb.Label{Name: pairs[i], Value: pairs[i+1]})
+	}
+	return s
+}
+
+func TestSeriesValidatorCheck(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		scheme      model.ValidationScheme
+		previous    []bridgeSeries
+		series      []bridgeSeries
+		wantKept    []string
+		wantDropped map[string]int
+	}{
+		{
+			name:     "valid series are sorted and kept",
+			scheme:   model.LegacyValidation,
+			series:   []bridgeSeries{labelledSeries(1000, "job", "a", "__name__", "up")},
+			wantKept: []string{"up"},
+		},
+		{
+			name:        "duplicate label name",
+			scheme:      model.LegacyValidation,
+			series:      []bridgeSeries{labelledSeries(1000, "__name__", "up", "job", "a", "job", "b")},
+			wantDropped: map[string]int{dropDuplicateLabel: 1},
+		},
+		{
+			name:        "invalid label name",
+			scheme:      model.LegacyValidation,
+			series:      []bridgeSeries{labelledSeries(1000, "__name__", "up", "bad-name", "a"), labelledSeries(1000, "__name__", "ok")},
+			wantKept:    []string{"ok"},
+			wantDropped: map[string]int{dropInvalidLabelName: 1},
+		},
+		{
+			name:     "label name valid under utf8",
+			scheme:   model.UTF8Validation,
+			series:   []bridgeSeries{labelledSeries(1000, "__name__", "up", "bad-name", "a")},
+			wantKept: []string{"up"},
+		},
+		{
+			name:        "invalid metric name",
+			scheme:      model.LegacyValidation,
+			series:      []bridgeSeries{labelledSeries(1000, "__name__", "http.requests")},
+			wantDropped: map[string]int{dropInvalidMetricName: 1},
+		},
+		{
+			name:     "metric name valid under utf8",
+			scheme:   model.UTF8Validation,
+			series:   []bridgeSeries{labelledSeries(1000, "__name__", "http.requests")},
+			wantKept: []string{"http.requests"},
+		},
+		{
+			name:        "missing metric name",
+			scheme:      model.LegacyValidation,
+			series:      []bridgeSeries{labelledSeries(1000, "job", "a")},
+			wantDropped: map[string]int{dropInvalidMetricName: 1},
+		},
+		{
+			name:        "invalid utf8 value",
+			scheme:      model.UTF8Validation,
+			series:      []bridgeSeries{labelledSeries(1000, "__name__", "up", "job", "\xff")},
+			wantDropped: map[string]int{dropInvalidUTF8: 1},
+		},
+		{
+			name:        "duplicate series",
+			scheme:      model.LegacyValidation,
+			series:      []bridgeSeries{labelledSeries(1000, "__name__", "up", "job", "a"), labelledSeries(1000, "job", "a", "__name__", "up")},
+			wantKept:    []string{"up"},
+			wantDropped: map[string]int{dropDuplicateSeries: 1},
+		},
+		{
+			name:        "out of order",
+			scheme:      model.LegacyValidation,
+			previous:    []bridgeSeries{labelledSeries(2000, "__name__", "up")},
+			series:      []bridgeSeries{labelledSeries(1000, "__name__", "up")},
+			wantDropped: map[string]int{dropOutOfOrder: 1},
+		},
+		{
+			name:     "same timestamp is skipped quietly",
+			scheme:   model.LegacyValidation,
+			previous: []bridgeSeries{labelledSeries(1000, "__name__", "up")},
+			series:   []bridgeSeries{labelledSeries(1000, "__name__", "up")},
+		},
+		{
+			name:     "newer timestamp",
+			scheme:   model.LegacyValidation,
+			previous: []bridgeSeries{labelledSeries(1000, "__name__", "up")},
+			series:   []bridgeSeries{labelledSeries(2000, "__name__", "up")},
+			wantKept: []string{"up"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v := newSeriesValidator()
+			if tc.previous != nil {
+				v.check(tc.previous, tc.scheme)
+			}
+
+			kept, dropped := v.check(tc.series, tc.scheme)
+			var names []string
+			for _, s := range kept {
+				names = append(names, labelValue(s.Labels, model.MetricNameLabel))
+				if !slices.IsSortedFunc(s.Labels, func(a, b prompb.Label) int { return strings.Compare(a.Name, b.Name) }) {
+					t.Errorf("labels not sorted: %v", s.Labels)
+				}
+			}
+			if !slices.Equal(names, tc.wantKept) {
+				t.Errorf("got kept %v, want %v", names, tc.wantKept)
+			}
+			if tc.wantDropped == nil {
+				tc.wantDropped = map[string]int{}
+			}
+			if !maps.Equal(dropped, tc.wantDropped) {
+				t.Errorf("got dropped %v, want %v", dropped, tc.wantDropped)
+			}
+		})
+	}
+}
+
+func TestSeriesValidatorForgetsMissingSeries(t *testing.T) {
+	v := newSeriesValidator()
+	v.check([]bridgeSeries{labelledSeries(2000, "__name__", "up")}, model.LegacyValidation)
+	v.check([]bridgeSeries{labelledSeries(3000, "__name__", "other")}, model.LegacyValidation)
+
+	// A series that went away starts over when it comes back
+	kept, dropped := v.check([]bridgeSeries{labelledSeries(1000, "__name__", "up")}, model.LegacyValidation)
+	if len(kept) != 1 || len(dropped) != 0 {
+		t.Errorf("got kept %d and dropped %v, want the returning series kept", len(kept), dropped)
+	}
+}
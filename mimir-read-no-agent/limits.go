@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Limit names, used in errors and as the limit label of bridge_scrape_limit_exceeded_total
+const (
+	limitBodySize         = "body_size_limit"
+	limitSample           = "sample_limit"
+	limitLabel            = "label_limit"
+	limitLabelNameLength  = "label_name_length_limit"
+	limitLabelValueLength = "label_value_length_limit"
+)
+
+// limitError fails a scrape that exceeded one of the target's limits
+type limitError struct {
+	limit string
+	msg   string
+}
+
+func (e *limitError) Error() string {
+	return fmt.Sprintf("%s exceeded: %s", e.limit, e.msg)
+}
+
+// exceededLimit returns the name of the limit err reports, if any
+func exceededLimit(err error) (string, bool) {
+	var le *limitError
+	if errors.As(err, &le) {
+		return le.limit, true
+	}
+	return "", false
+}
+
+// checkLimits returns an error if the series of a scrape, after
+// metric_relabel_configs, break the target's sample or label limits
+func (t *TargetConfig) checkLimits(series []bridgeSeries) error {
+	if t.SampleLimit > 0 && len(series) > t.SampleLimit {
+		return &limitError{limitSample, fmt.Sprintf("%d samples, limit is %d", len(series), t.SampleLimit)}
+	}
+
+	if t.LabelLimit == 0 && t.LabelNameLengthLimit == 0 && t.LabelValueLengthLimit == 0 {
+		return nil
+	}
+	for _, s := range series {
+		if t.LabelLimit > 0 && len(s.Labels) > t.LabelLimit {
+			return &limitError{limitLabel, fmt.Sprintf("%s has %d labels, limit is %d", seriesName(s), len(s.Labels), t.LabelLimit)}
+		}
+		for _, l := range s.Labels {
+			if t.LabelNameLengthLimit > 0 && len(l.Name) > t.LabelNameLengthLimit {
+				return &limitError{limitLabelNameLength, fmt.Sprintf("%s has label name %q of length %d, limit is %d", seriesName(s), l.Name, len(l.Name), t.LabelNameLengthLimit)}
+			}
+			if t.LabelValueLengthLimit > 0 && len(l.Value) > t.LabelValueLengthLimit {
+				return &limitError{limitLabelValueLength, fmt.Sprintf("%s has value of label %q of length %d, limit is %d", seriesName(s), l.Name, len(l.Value), t.LabelValueLengthLimit)}
+			}
+		}
+	}
+
+	return nil
+}
+
+func seriesName(s bridgeSeries) string {
+	for _, l := range s.Labels {
+		if l.Name == "__name__" {
+			return l.Value
+		}
+	}
+	return "series"
+}
+
+// byteSize is a size in bytes written as a number with an optional unit,
+// like Prometheus' body_size_limit: 512KB, 10MB or 1GiB. Units are powers of 1024.
+type byteSize int64
+
+var byteSizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+	{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30},
+	{"B", 1},
+}
+
+func parseByteSize(s string) (byteSize, error) {
+	num := strings.TrimSpace(s)
+	multiplier := int64(1)
+	for _, u := range byteSizeUnits {
+		if strings.HasSuffix(num, u.suffix) {
+			num, multiplier = strings.TrimSpace(strings.TrimSuffix(num, u.suffix)), u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return byteSize(n * multiplier), nil
+}
+
+func (b *byteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	size, err := parseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
+
+func (b byteSize) MarshalYAML() (interface{}, error) {
+	return strconv.FormatInt(int64(b), 10) + "B", nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestCheckLimits(t *testing.T) {
+	series := []bridgeSeries{
+		labelledSeries(1000, "__name__", "a_total", "job", "test"),
+		labelledSeries(1000, "__name__", "b_total", "job", "test", "path", "/a/very/long/path"),
+	}
+
+	for _, tc := range []struct {
+		name   string
+		target TargetConfig
+		limit  string
+	}{
+		{"no limits", TargetConfig{}, ""},
+		{"under limits", TargetConfig{SampleLimit: 2, LabelLimit: 3, LabelNameLengthLimit: 8, LabelValueLengthLimit: 17}, ""},
+		{"sample limit", TargetConfig{SampleLimit: 1}, limitSample},
+		{"label limit", TargetConfig{LabelLimit: 2}, limitLabel},
+		{"label name length", TargetConfig{LabelNameLengthLimit: 7}, limitLabelNameLength},
+		{"label value length", TargetConfig{LabelValueLengthLimit: 10}, limitLabelValueLength},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.target.checkLimits(series)
+			limit, ok := exceededLimit(err)
+			if tc.limit == "" {
+				if err != nil {
+					t.Errorf("got %v, want no error", err)
+				}
+				return
+			}
+			if !ok || limit != tc.limit {
+				t.Errorf("got %v, want %s exceeded", err, tc.limit)
+			}
+		})
+	}
+
+	if _, ok := exceededLimit(fmt.Errorf("failed to scrape: %w", &limitError{limitBodySize, "too big"})); !ok {
+		t.Error("wrapped limit error not recognized")
+	}
+	if _, ok := exceededLimit(fmt.Errorf("connection refused")); ok {
+		t.Error("other error reported as a limit")
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want byteSize
+		err  bool
+	}{
+		{"0", 0, false},
+		{"512", 512, false},
+		{"100B", 100, false},
+		{"512KB", 512 << 10, false},
+		{"10MB", 10 << 20, false},
+		{"10 MiB", 10 << 20, false},
+		{"1GiB", 1 << 30, false},
+		{"1GB", 1 << 30, false},
+		{"", 0, true},
+		{"-1KB", 0, true},
+		{"1.5MB", 0, true},
+		{"10TB", 0, true},
+	} {
+		got, err := parseByteSize(tc.in)
+		if (err != nil) != tc.err || got != tc.want {
+			t.Errorf("parseByteSize(%q) = %d, %v, want %d, error %v", tc.in, got, err, tc.want, tc.err)
+		}
+	}
+}
+
+// testTarget serves a text exposition that tests can change between scrapes
+type testTarget struct {
+	*httptest.Server
+
+	mu   sync.Mutex
+	body string
+}
+
+func newTestTarget(t *testing.T, body string) *testTarget {
+	target := &testTarget{body: body}
+	target.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target.mu.Lock()
+		defer target.mu.Unlock()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write([]byte(target.body))
+	}))
+	t.Cleanup(target.Close)
+	return target
+}
+
+func (target *testTarget) set(body string) {
+	target.mu.Lock()
+	defer target.mu.Unlock()
+	target.body = body
+}
+
+// lastValues maps the name of every series a receiver got to its last sample
+func lastValues(recv *testReceiver) map[string]prompb.Sample {
+	got := make(map[string]prompb.Sample)
+	for _, s := range recv.received() {
+		got[labelValue(s.Labels, model.MetricNameLabel)] = s.Samples[len(s.Samples)-1]
+	}
+	return got
+}
+
+func TestScrapeLimitReporting(t *testing.T) {
+	const exposition = "a_total 1\nb_total 2\nc_total{path=\"/a/long/path\"} 3\n"
+
+	for _, tc := range []struct {
+		name, limits string
+		wantScraped  float64
+	}{
+		{"sample_limit", "sample_limit: 2", 3},
+		{"label_limit", "label_limit: 3", 3},
+		{"body_size_limit", "body_size_limit: 10B", 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			target := newTestTarget(t, "a_total 1\n")
+			recv := newTestReceiver(t)
+			rw := testRemoteWriteConfig(recv.URL)
+			writer := newTestWriter(t, &rw)
+
+			cfg, err := loadTestConfig(t, fmt.Sprintf("targets:\n  - url: %s/metrics\n    job: test\n    %s\n", target.URL, tc.limits), configOverrides{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			state := newTargetState()
+			agg := newAggregator(writer)
+
+			scrapeAndPush(context.Background(), http.DefaultClient, writer, agg, cfg.Targets[0], state)
+			waitFor(t, "the first scrape", func() bool { return len(recv.received()) == 6 })
+			if got := lastValues(recv); got["up"].Value != 1 || got["a_total"].Value != 1 {
+				t.Fatalf("got %v after a scrape under the limits, want up 1 and a_total", got)
+			}
+
+			// Over the limit nothing scraped is sent, up is 0 and the last
+			// scrape's series are marked stale
+			target.set(exposition)
+			scrapeAndPush(context.Background(), http.DefaultClient, writer, agg, cfg.Targets[0], state)
+			waitFor(t, "the second scrape", func() bool { return len(recv.received()) == 12 })
+
+			got := lastValues(recv)
+			if _, ok := got["b_total"]; ok {
+				t.Error("series of the failed scrape were sent")
+			}
+			if !value.IsStaleNaN(got["a_total"].Value) {
+				t.Errorf("got a_total %v, want a stale marker", got["a_total"])
+			}
+			want := map[string]float64{
+				"up":                                    0,
+				"scrape_samples_scraped":                tc.wantScraped,
+				"scrape_samples_post_metric_relabeling": tc.wantScraped,
+				"scrape_series_added":                   0,
+			}
+			for name, v := range want {
+				if got[name].Value != v || got[name].Timestamp != got["up"].Timestamp {
+					t.Errorf("%s: got %v, want %v", name, got[name], v)
+				}
+			}
+			if _, ok := got["scrape_duration_seconds"]; !ok {
+				t.Error("scrape_duration_seconds not reported")
+			}
+		})
+	}
+}
+
+func TestByteSizeYAML(t *testing.T) {
+	cfg, err := loadTestConfig(t, "targets:\n  - url: http://app:8080/metrics\n    job: test\n    body_size_limit: 10MB\n", configOverrides{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.Targets[0].BodySizeLimit; got != 10<<20 {
+		t.Errorf("got body_size_limit %d, want %d", got, 10<<20)
+	}
+
+	_, err = loadTestConfig(t, "targets:\n  - url: http://app:8080/metrics\n    job: test\n    body_size_limit: lots\n", configOverrides{})
+	if err == nil || !strings.Contains(err.Error(), `invalid size "lots"`) {
+		t.Errorf("got %v, want an invalid size error", err)
+	}
+}
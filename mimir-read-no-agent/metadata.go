@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// metadataStore collects the metadata of the metric families written to a
+// queue since the last metadata send
+type metadataStore struct {
+	mu       sync.Mutex
+	families map[string]prompb.MetricMetadata
+}
+
+func newMetadataStore() *metadataStore {
+	return &metadataStore{families: make(map[string]prompb.MetricMetadata)}
+}
+
+// observe records the metadata of the series, skipping series without any
+func (m *metadataStore) observe(series []bridgeSeries) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, s := range series {
+		if s.Metadata.MetricFamilyName == "" {
+			continue
+		}
+		m.families[s.Metadata.MetricFamilyName] = s.Metadata
+	}
+}
+
+// take returns the collected metadata sorted by family name and forgets it
+func (m *metadataStore) take() []prompb.MetricMetadata {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	metadata := make([]prompb.MetricMetadata, 0, len(m.families))
+	for _, md := range m.families {
+		metadata = append(metadata, md)
+	}
+	clear(m.families)
+
+	sort.Slice(metadata, func(i, j int) bool {
+		return metadata[i].MetricFamilyName < metadata[j].MetricFamilyName
+	})
+	return metadata
+}
+
+// runMetadata sends the collected metadata every send_interval while the
+// queue uses remote write 1.0, which has no room for it next to the samples
+func (q *queueManager) runMetadata() {
+	ticker := time.NewTicker(time.Duration(q.metadataCfg.SendInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		metadata := q.metadata.take()
+		if len(metadata) == 0 || q.protoMsg.Load() != remoteWriteProtoMsgV1 {
+			continue
+		}
+
+		for len(metadata) > 0 {
+			n := min(len(metadata), q.metadataCfg.MaxSamplesPerSend)
+			q.sendMetadata(metadata[:n])
+			metadata = metadata[n:]
+		}
+	}
+}
+
+// sendMetadata pushes a batch of metadata, retrying recoverable errors until
+// the next send is due. Metadata is resent every interval anyway, so giving
+// up loses nothing for long.
+func (q *queueManager) sendMetadata(metadata []prompb.MetricMetadata) {
+	deadline := time.Now().Add(time.Duration(q.metadataCfg.SendInterval))
+	backoff := time.Duration(q.cfg.MinBackoff)
+
+	for attempt := 1; ; attempt++ {
+		n, err := pushMetadata(q.ctx, q.client, q.url, q.tenant, metadata)
+		if q.ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			metadataSentTotal.WithLabelValues(q.name, q.url, q.tenant).Add(float64(len(metadata)))
+			bytesSentTotal.WithLabelValues(q.name, q.url, q.tenant).Add(float64(n))
+			return
+		}
+
+		var rerr *recoverableError
+		if !errors.As(err, &rerr) || (rerr.statusCode == http.StatusTooManyRequests && !q.cfg.RetryOnRateLimit) || time.Now().Add(backoff).After(deadline) {
+			log.Printf("Dropping metadata for %d metric families: %v\n", len(metadata), err)
+			metadataFailedTotal.WithLabelValues(q.name, q.url, q.tenant).Add(float64(len(metadata)))
+			return
+		}
+
+		log.Printf("Error pushing metadata to %s (attempt %d, retrying in %v): %v\n", q.url, attempt, backoff, err)
+		metadataRetriedTotal.WithLabelValues(q.name, q.url, q.tenant).Add(float64(len(metadata)))
+		select {
+		case <-q.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > time.Duration(q.cfg.MaxBackoff) {
+			backoff = time.Duration(q.cfg.MaxBackoff)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The bridge's own metrics, served on -web.listen-address. Remote write
+// metrics use the names of Prometheus' and Alloy's remote storage metrics so
+// existing remote write dashboards work for the bridge too.
+var (
+	scrapesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bridge_scrapes_total",
+			Help: "Total number of scrapes of each target",
+		},
+		[]string{"job", "instance"},
+	)
+
+	scrapeFailuresTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bridge_scrape_failures_total",
+			Help: "Total number of scrapes that failed to fetch or decode the target's metrics",
+		},
+		[]string{"job", "instance"},
+	)
+
+	scrapeLimitExceededTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bridge_scrape_limit_exceeded_total",
+			Help: "Total number of scrapes failed because they exceeded one of the target's limits",
+		},
+		[]string{"job", "instance", "limit"},
+	)
+
+	exemplarsDroppedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bridge_exemplars_dropped_total",
+			Help: "Total number of scraped exemplars dropped by the target's exemplar_limit",
+		},
+		[]string{"job", "instance"},
+	)
+
+	seriesDroppedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bridge_series_dropped_total",
+			Help: "Total number of scraped series dropped because Mimir would reject them: invalid names or UTF-8, duplicates or out-of-order samples",
+		},
+		[]string{"job", "instance", "reason"},
+	)
+
+	conversionErrorsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bridge_conversion_errors_total",
+			Help: "Total number of scrapes whose metrics could not be converted to remote write series",
+		},
+		[]string{"job", "instance"},
+	)
+
+	scrapeDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "bridge_scrape_duration_seconds",
+			Help:    "Time taken to fetch and decode a target's metrics",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"job", "instance"},
+	)
+
+	scrapeTicksSkippedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bridge_scrape_ticks_skipped_total",
+			Help: "Total number of scheduled scrapes skipped because the previous scrape overran the target's interval",
+		},
+		[]string{"job", "instance"},
+	)
+
+	samplesSentTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "prometheus_remote_storage_samples_total",
+			Help: "Total number of samples successfully sent to remote storage",
+		},
+		[]string{"remote_name", "url", "tenant"},
+	)
+
+	samplesFailedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "prometheus_remote_storage_samples_failed_total",
+			Help: "Total number of samples dropped because they were rejected or too old to retry",
+		},
+		[]string{"remote_name", "url", "tenant"},
+	)
+
+	remoteWriteSeriesDroppedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bridge_remote_write_series_dropped_total",
+			Help: "Total number of series not sent to a remote write endpoint, by reason",
+		},
+		[]string{"remote_name", "url", "reason"},
+	)
+
+	samplesRetriedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "prometheus_remote_storage_samples_retried_total",
+			Help: "Total number of samples resent after a recoverable error",
+		},
+		[]string{"remote_name", "url", "tenant"},
+	)
+
+	bytesSentTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "prometheus_remote_storage_bytes_total",
+			Help: "Total number of compressed bytes sent to remote storage",
+		},
+		[]string{"remote_name", "url", "tenant"},
+	)
+
+	sentBatchDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "prometheus_remote_storage_sent_batch_duration_seconds",
+			Help:    "Duration of each push to remote storage, including failed attempts",
+			Buckets: append(prometheus.DefBuckets, 25, 60, 120, 300),
+		},
+		[]string{"remote_name", "url", "tenant"},
+	)
+
+	metadataSentTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "prometheus_remote_storage_metadata_total",
+			Help: "Total number of metric metadata entries successfully sent to remote storage",
+		},
+		[]string{"remote_name", "url", "tenant"},
+	)
+
+	metadataFailedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "prometheus_remote_storage_metadata_failed_total",
+			Help: "Total number of metric metadata entries dropped after a failed send",
+		},
+		[]string{"remote_name", "url", "tenant"},
+	)
+
+	metadataRetriedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "prometheus_remote_storage_metadata_retried_total",
+			Help: "Total number of metric metadata entries resent after a recoverable error",
+		},
+		[]string{"remote_name", "url", "tenant"},
+	)
+
+	samplesPending = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "prometheus_remote_storage_samples_pending",
+			Help: "Number of samples queued or in flight in the shards",
+		},
+		[]string{"remote_name", "url", "tenant"},
+	)
+
+	shardsCount = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "prometheus_remote_storage_shards",
+			Help: "Number of shards sending samples in parallel",
+		},
+		[]string{"remote_name", "url", "tenant"},
+	)
+
+	configLastReloadSuccessful = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "bridge_config_last_reload_successful",
+		Help: "Whether the last configuration reload attempt was successful",
+	})
+
+	configLastReloadSuccessTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "bridge_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful configuration reload",
+	})
+
+	walSizeBytes = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "bridge_wal_size_bytes",
+			Help: "Size of the records waiting in the write-ahead log",
+		},
+		[]string{"remote_name", "url", "tenant"},
+	)
+)
@@ -2,78 +2,224 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gogo/protobuf/proto"
 	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/client_model/go"
-	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/prometheus/prompb"
-)
-
-const (
-	metricsURL     = "http://localhost:8080/metrics"
-	mimirWriteURL  = "http://localhost:9009/api/v1/push"
-	scrapeInterval = 5 * time.Second
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func main() {
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
+	configFile := flag.String("config.file", os.Getenv("BRIDGE_CONFIG_FILE"),
+		"Path to the YAML config file [env BRIDGE_CONFIG_FILE]")
+	listenAddress := flag.String("web.listen-address", envOr("BRIDGE_WEB_LISTEN_ADDRESS", ":9099"),
+		"Address to serve the bridge's own metrics and /-/reload on [env BRIDGE_WEB_LISTEN_ADDRESS]")
+	remoteWriteURL := flag.String("remote-write.url", os.Getenv("BRIDGE_REMOTE_WRITE_URL"),
+		"Overrides the url of the first remote_write endpoint in the config file [env BRIDGE_REMOTE_WRITE_URL]")
+	walDirectory := flag.String("wal.directory", os.Getenv("BRIDGE_WAL_DIRECTORY"),
+		"Overrides wal.directory from the config file [env BRIDGE_WAL_DIRECTORY]")
+	drainTimeout := flag.Duration("shutdown.drain-timeout", envDuration("BRIDGE_SHUTDOWN_DRAIN_TIMEOUT", 25*time.Second),
+		"How long to keep sending queued samples after SIGTERM [env BRIDGE_SHUTDOWN_DRAIN_TIMEOUT]")
+	flag.Parse()
 
 	log.Println("Starting Prometheus -> Mimir Bridge")
-	log.Printf("Scraping from: %s\n", metricsURL)
-	log.Printf("Pushing to: %s\n", mimirWriteURL)
-	log.Printf("Interval: %v\n", scrapeInterval)
-	log.Println("Press Ctrl+C to stop\n")
 
-	ticker := time.NewTicker(scrapeInterval)
-	defer ticker.Stop()
+	b, err := newBridge(*configFile, configOverrides{
+		remoteWriteURL: *remoteWriteURL,
+		walDirectory:   *walDirectory,
+	})
+	if err != nil {
+		log.Fatalf("Error starting bridge: %v", err)
+	}
 
-	// Scrape and push immediately, then on ticker
-	scrapeAndPush(client)
+	log.Printf("Pushing to: %s\n", strings.Join(b.writer.urls(), ", "))
+	log.Printf("WAL: %s\n", b.cfg.WAL.Directory)
+	log.Printf("Bridge metrics: %s/metrics\n", *listenAddress)
+	log.Print("Press Ctrl+C to stop\n\n")
 
-	for range ticker.C {
-		scrapeAndPush(client)
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/-/reload", b.handleReload)
+	go func() {
+		if err := http.ListenAndServe(*listenAddress, nil); err != nil {
+			log.Fatalf("Error serving metrics: %v", err)
+		}
+	}()
+
+	// SIGHUP reloads the config file, like Prometheus and Alloy. SIGTERM
+	// (sent by Kubernetes before killing the pod) and Ctrl+C shut down.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			if err := b.reload(); err != nil {
+				log.Printf("Error reloading config: %v\n", err)
+			}
+			continue
+		}
+
+		log.Printf("Received %v, draining queued samples for up to %v\n", sig, *drainTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+		b.shutdown(ctx)
+		cancel()
+		log.Println("Shutdown complete")
+		return
 	}
 }
 
-func scrapeAndPush(client *http.Client) {
-	// Scrape metrics
-	metrics, err := scrapeMetrics(client, metricsURL)
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
 	if err != nil {
-		log.Printf("Error scraping metrics: %v\n", err)
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return d
+}
+
+func scrapeAndPush(ctx context.Context, scrapeClient *http.Client, writer *fanoutWriter, agg *aggregator, target *TargetConfig, state *targetState) {
+	// Every sample of a scrape gets the time the scrape started
+	start := time.Now()
+	scrapeTime := start.UnixMilli()
+
+	// Scrape metrics. Cancelling ctx stops the target; the timeout only
+	// fails this scrape.
+	scrapeCtx, cancel := context.WithTimeout(ctx, time.Duration(target.Timeout))
+	metrics, err := scrapeMetrics(scrapeCtx, scrapeClient, target.scrapeURL, target.acceptHeader, int64(target.BodySizeLimit))
+	cancel()
+	report := scrapeReport{duration: time.Since(start)}
+
+	// The target is being stopped, which writes its stale markers instead
+	if ctx.Err() != nil {
 		return
 	}
 
-	log.Printf("Scraped %d metric families\n", len(metrics))
+	scrapesTotal.WithLabelValues(target.Job, target.Instance).Inc()
+	scrapeDuration.WithLabelValues(target.Job, target.Instance).Observe(report.duration.Seconds())
+	if err != nil {
+		log.Printf("[%s] Error scraping metrics: %v\n", target, err)
+		scrapeFailuresTotal.WithLabelValues(target.Job, target.Instance).Inc()
+		if limit, ok := exceededLimit(err); ok {
+			scrapeLimitExceededTotal.WithLabelValues(target.Job, target.Instance, limit).Inc()
+		}
+		writeFailedScrape(writer, target, state.stale, report, scrapeTime)
+		return
+	}
+
+	log.Printf("[%s] Scraped %d metric families\n", target, len(metrics))
 
 	// Convert to Prometheus remote write format
-	timeseries, err := convertToTimeseries(metrics)
+	timeseries, err := convertToTimeseries(metrics, target.targetLabels(), scrapeTime, *target.HonorTimestamps, target.AlwaysScrapeClassicHistograms)
 	if err != nil {
-		log.Printf("Error converting metrics: %v\n", err)
+		log.Printf("[%s] Error converting metrics: %v\n", target, err)
+		conversionErrorsTotal.WithLabelValues(target.Job, target.Instance).Inc()
+		writeFailedScrape(writer, target, state.stale, report, scrapeTime)
+		return
+	}
+	report.samplesScraped = len(timeseries)
+
+	// Apply metric_relabel_configs
+	timeseries = relabelSeries(timeseries, target.MetricRelabelConfigs)
+	report.samplesPostRelabel = len(timeseries)
+
+	// Drop the whole scrape rather than push a partial one
+	if err := target.checkLimits(timeseries); err != nil {
+		log.Printf("[%s] Error scraping metrics: %v\n", target, err)
+		limit, _ := exceededLimit(err)
+		scrapeLimitExceededTotal.WithLabelValues(target.Job, target.Instance, limit).Inc()
+		writeFailedScrape(writer, target, state.stale, report, scrapeTime)
 		return
 	}
+	report.up = true
+
+	// Drop series Mimir would reject along with the rest of their batch. This
+	// runs after the limits so a failed scrape does not advance the
+	// timestamps the validator remembers.
+	timeseries, dropped := state.validator.check(timeseries, target.MetricNameValidationScheme)
+	logDropped(target, dropped)
+
+	// Convert between delta and cumulative counters
+	timeseries = state.temporality.convert(timeseries, target.TemporalityConversions, time.Now())
+
+	// Forward only exemplars not sent before, up to exemplar_limit
+	if dropped := state.exemplars.filter(timeseries, target.ExemplarLimit); dropped > 0 {
+		log.Printf("[%s] Dropping %d exemplars over the exemplar_limit of %d\n", target, dropped, target.ExemplarLimit)
+		exemplarsDroppedTotal.WithLabelValues(target.Job, target.Instance).Add(float64(dropped))
+	}
+
+	// Hand series matched by stream_aggregation rules to the aggregator
+	timeseries = agg.aggregate(timeseries, target.Tenant)
+
+	log.Printf("[%s] Converted to %d timeseries\n", target, len(timeseries))
+
+	// Mark series that were in the previous scrape but not in this one as stale
+	markers, added := state.stale.update(timeseries, scrapeTime)
+	report.seriesAdded = added
+	if len(markers) > 0 {
+		log.Printf("[%s] Marking %d disappeared series stale\n", target, len(markers))
+		timeseries = append(timeseries, markers...)
+	}
 
-	log.Printf("Converted to %d timeseries\n", len(timeseries))
+	// up and the scrape_* series, which metric_relabel_configs do not apply to
+	timeseries = append(timeseries, report.series(target.targetLabels(), scrapeTime)...)
 
-	// Push to Mimir
-	err = pushToMimir(client, mimirWriteURL, timeseries)
+	// Write to the WAL of each tenant, the queue managers batch and push to Mimir
+	err = writer.write(timeseries, target.Tenant)
 	if err != nil {
-		log.Printf("Error pushing to Mimir: %v\n", err)
+		log.Printf("[%s] Error writing to WAL: %v\n", target, err)
 		return
 	}
 
-	log.Printf("✓ Successfully pushed metrics to Mimir at %s\n\n", time.Now().Format("15:04:05"))
+	log.Printf("[%s] ✓ Queued metrics for Mimir at %s\n\n", target, time.Now().Format("15:04:05"))
+}
+
+// writeFailedScrape reports a target as down and ends every series of its last scrape
+func writeFailedScrape(writer *fanoutWriter, target *TargetConfig, stale *staleTracker, report scrapeReport, scrapeTime int64) {
+	markers := stale.markAll(scrapeTime)
+	if len(markers) > 0 {
+		log.Printf("[%s] Marking %d series stale\n", target, len(markers))
+	}
+
+	timeseries := append(markers, report.series(target.targetLabels(), scrapeTime)...)
+	if err := writer.write(timeseries, target.Tenant); err != nil {
+		log.Printf("[%s] Error writing to WAL: %v\n", target, err)
+	}
 }
 
-func scrapeMetrics(client *http.Client, url string) (map[string]*io_prometheus_client.MetricFamily, error) {
-	resp, err := client.Get(url)
+// scrapeMetrics fetches the target's metrics, negotiating the exposition
+// format with accept and decoding whichever format the target answered with.
+// A bodySizeLimit above 0 fails scrapes whose uncompressed body is larger.
+func scrapeMetrics(ctx context.Context, client *http.Client, url, accept string, bodySizeLimit int64) (map[string]*io_prometheus_client.MetricFamily, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", accept)
+
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to scrape: %w", err)
 	}
@@ -83,127 +229,93 @@ func scrapeMetrics(client *http.Client, url string) (map[string]*io_prometheus_c
 		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
 
-	decoder := expfmt.NewDecoder(resp.Body, expfmt.NewFormat(expfmt.TypeTextPlain))
-	
-	metrics := make(map[string]*io_prometheus_client.MetricFamily)
-	
-	for {
-		mf := &io_prometheus_client.MetricFamily{}
-		err := decoder.Decode(mf)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, fmt.Errorf("failed to decode: %w", err)
-		}
-		
-		metrics[mf.GetName()] = mf
+	var reader io.Reader = resp.Body
+	if bodySizeLimit > 0 {
+		reader = io.LimitReader(resp.Body, bodySizeLimit+1)
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if bodySizeLimit > 0 && int64(len(body)) > bodySizeLimit {
+		return nil, &limitError{limitBodySize, fmt.Sprintf("body is larger than %d bytes", bodySizeLimit)}
 	}
 
-	return metrics, nil
+	return decodeScrape(body, resp.Header.Get("Content-Type"))
 }
 
-func convertToTimeseries(metricFamilies map[string]*io_prometheus_client.MetricFamily) ([]prompb.TimeSeries, error) {
-	timestamp := time.Now().UnixMilli()
-	var timeseries []prompb.TimeSeries
+// convertToTimeseries converts scraped metric families, keyed by their family
+// name, to remote write series.
+// Samples are stamped with scrapeTime unless honorTimestamps is set and the
+// target exposed a timestamp of its own. Histograms with native buckets only
+// keep their classic buckets when classicHistograms is set.
+func convertToTimeseries(metricFamilies map[string]*io_prometheus_client.MetricFamily, targetLabels []prompb.Label, scrapeTime int64, honorTimestamps, classicHistograms bool) ([]bridgeSeries, error) {
+	var timeseries []bridgeSeries
 
-	for _, mf := range metricFamilies {
+	for familyName, mf := range metricFamilies {
 		metricName := mf.GetName()
 		metricType := mf.GetType()
+		metadata := familyMetadata(familyName, mf)
 
 		for _, metric := range mf.GetMetric() {
-			// Build labels
-			labels := []prompb.Label{
-				{Name: "__name__", Value: metricName},
-			}
+			// Metric labels plus job, instance and extra target labels
+			b := newLabelBuilder(metric.GetLabel(), targetLabels)
 
-			// Add metric labels
-			for _, label := range metric.GetLabel() {
-				labels = append(labels, prompb.Label{
-					Name:  label.GetName(),
-					Value: label.GetValue(),
-				})
+			timestamp := scrapeTime
+			if honorTimestamps && metric.TimestampMs != nil {
+				timestamp = metric.GetTimestampMs()
 			}
 
-			// Extract value based on metric type
-			var value float64
-			var found bool
+			// Extract series based on metric type
+			var converted []prompb.TimeSeries
+			var created *timestamppb.Timestamp
 
 			switch metricType {
 			case io_prometheus_client.MetricType_COUNTER:
 				if metric.Counter != nil {
-					value = metric.Counter.GetValue()
-					found = true
+					converted = append(converted, prompb.TimeSeries{
+						Labels:    b.labels(metricName),
+						Samples:   []prompb.Sample{{Value: metric.Counter.GetValue(), Timestamp: timestamp}},
+						Exemplars: convertExemplars([]*io_prometheus_client.Exemplar{metric.Counter.GetExemplar()}, timestamp),
+					})
+					created = metric.Counter.GetCreatedTimestamp()
 				}
 			case io_prometheus_client.MetricType_GAUGE:
 				if metric.Gauge != nil {
-					value = metric.Gauge.GetValue()
-					found = true
+					converted = append(converted, prompb.TimeSeries{
+						Labels:  b.labels(metricName),
+						Samples: []prompb.Sample{{Value: metric.Gauge.GetValue(), Timestamp: timestamp}},
+					})
 				}
 			case io_prometheus_client.MetricType_UNTYPED:
 				if metric.Untyped != nil {
-					value = metric.Untyped.GetValue()
-					found = true
+					converted = append(converted, prompb.TimeSeries{
+						Labels:  b.labels(metricName),
+						Samples: []prompb.Sample{{Value: metric.Untyped.GetValue(), Timestamp: timestamp}},
+					})
 				}
 			case io_prometheus_client.MetricType_SUMMARY:
-				// For summaries, we export count and sum
+				// For summaries, we export quantile, _sum and _count series
 				if metric.Summary != nil {
-					// Sum
-					timeseries = append(timeseries, prompb.TimeSeries{
-						Labels: append(labels, prompb.Label{Name: "quantile", Value: "sum"}),
-						Samples: []prompb.Sample{
-							{Value: metric.Summary.GetSampleSum(), Timestamp: timestamp},
-						},
-					})
-					// Count
-					timeseries = append(timeseries, prompb.TimeSeries{
-						Labels: append(labels, prompb.Label{Name: "quantile", Value: "count"}),
-						Samples: []prompb.Sample{
-							{Value: float64(metric.Summary.GetSampleCount()), Timestamp: timestamp},
-						},
-					})
+					converted = convertSummary(metricName, b, metric.Summary, timestamp)
+					created = metric.Summary.GetCreatedTimestamp()
 				}
-				continue
-			case io_prometheus_client.MetricType_HISTOGRAM:
-				// For histograms, we export buckets, sum, and count
+			case io_prometheus_client.MetricType_HISTOGRAM, io_prometheus_client.MetricType_GAUGE_HISTOGRAM:
+				// For histograms, we export _bucket, _sum and _count series or a native histogram
 				if metric.Histogram != nil {
-					for _, bucket := range metric.Histogram.GetBucket() {
-						bucketLabels := append(labels, prompb.Label{
-							Name:  "le",
-							Value: fmt.Sprintf("%v", bucket.GetUpperBound()),
-						})
-						timeseries = append(timeseries, prompb.TimeSeries{
-							Labels: bucketLabels,
-							Samples: []prompb.Sample{
-								{Value: float64(bucket.GetCumulativeCount()), Timestamp: timestamp},
-							},
-						})
-					}
-					// Sum
-					timeseries = append(timeseries, prompb.TimeSeries{
-						Labels: append(labels, prompb.Label{Name: "le", Value: "sum"}),
-						Samples: []prompb.Sample{
-							{Value: metric.Histogram.GetSampleSum(), Timestamp: timestamp},
-						},
-					})
-					// Count
-					timeseries = append(timeseries, prompb.TimeSeries{
-						Labels: append(labels, prompb.Label{Name: "le", Value: "count"}),
-						Samples: []prompb.Sample{
-							{Value: float64(metric.Histogram.GetSampleCount()), Timestamp: timestamp},
-						},
-					})
+					gauge := metricType == io_prometheus_client.MetricType_GAUGE_HISTOGRAM
+					converted = convertHistogram(metricName, b, metric.Histogram, gauge, classicHistograms, timestamp)
+					created = metric.Histogram.GetCreatedTimestamp()
 				}
-				continue
 			}
 
-			if found {
-				timeseries = append(timeseries, prompb.TimeSeries{
-					Labels: labels,
-					Samples: []prompb.Sample{
-						{Value: value, Timestamp: timestamp},
-					},
-				})
+			// Every series of a metric shares its created timestamp and family metadata
+			for _, ts := range converted {
+				s := bridgeSeries{TimeSeries: ts, Metadata: metadata}
+				if created != nil {
+					s.CreatedTimestamp = created.AsTime().UnixMilli()
+				}
+				timeseries = append(timeseries, s)
 			}
 		}
 	}
@@ -211,42 +323,111 @@ func convertToTimeseries(metricFamilies map[string]*io_prometheus_client.MetricF
 	return timeseries, nil
 }
 
-func pushToMimir(client *http.Client, url string, timeseries []prompb.TimeSeries) error {
-	// Create WriteRequest
-	writeRequest := &prompb.WriteRequest{
-		Timeseries: timeseries,
-	}
+// errProtoMsgUnsupported is returned when the receiver rejects the remote write 2.0 content type
+var errProtoMsgUnsupported = errors.New("remote write protobuf message not supported by receiver")
+
+// pushToMimir sends a batch for a tenant encoded as the given remote write
+// protobuf message and returns the number of compressed bytes sent
+func pushToMimir(ctx context.Context, client *http.Client, url, tenant string, batch []bridgeSeries, protoMsg string) (int, error) {
+	var data []byte
+	var err error
+	var contentType, version string
 
 	// Marshal to protobuf
-	data, err := proto.Marshal(writeRequest)
+	switch protoMsg {
+	case remoteWriteProtoMsgV2:
+		data, err = proto.Marshal(toV2Request(batch))
+		contentType = "application/x-protobuf;proto=" + remoteWriteProtoMsgV2
+		version = "2.0.0"
+	default:
+		data, err = proto.Marshal(&prompb.WriteRequest{Timeseries: v1Timeseries(batch)})
+		contentType = "application/x-protobuf"
+		version = "0.1.0"
+	}
 	if err != nil {
-		return fmt.Errorf("failed to marshal: %w", err)
+		return 0, fmt.Errorf("failed to marshal: %w", err)
 	}
 
+	resp, n, err := postToMimir(ctx, client, url, tenant, data, contentType, version)
+	if err != nil {
+		return 0, err
+	}
+
+	// Remote write 2.0 receivers report what they stored
+	if protoMsg == remoteWriteProtoMsgV2 {
+		if written := resp.Header.Get("X-Prometheus-Remote-Write-Samples-Written"); written != "" {
+			if n, err := strconv.Atoi(written); err == nil && n < countSamples(batch) {
+				log.Printf("Mimir stored %d of %d samples\n", n, countSamples(batch))
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// pushMetadata sends metric metadata in a remote write 1.0 request without samples
+func pushMetadata(ctx context.Context, client *http.Client, url, tenant string, metadata []prompb.MetricMetadata) (int, error) {
+	data, err := proto.Marshal(&prompb.WriteRequest{Metadata: metadata})
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal: %w", err)
+	}
+
+	_, n, err := postToMimir(ctx, client, url, tenant, data, "application/x-protobuf", "0.1.0")
+	return n, err
+}
+
+// postToMimir compresses and sends a marshaled write request, returning the
+// response and the number of bytes sent
+func postToMimir(ctx context.Context, client *http.Client, url, tenant string, data []byte, contentType, version string) (*http.Response, int, error) {
 	// Compress with snappy
 	compressed := snappy.Encode(nil, data)
 
 	// Create HTTP request
-	req, err := http.NewRequest("POST", url, bytes.NewReader(compressed))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(compressed))
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return nil, 0, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Encoding", "snappy")
-	req.Header.Set("Content-Type", "application/x-protobuf")
-	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", version)
+	if tenant != "" {
+		req.Header.Set("X-Scope-OrgID", tenant)
+	}
 
-	// Send request
+	// Send request, network errors are always worth retrying
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
+		return nil, 0, &recoverableError{err: fmt.Errorf("failed to send request: %w", err)}
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusUnsupportedMediaType && version == "2.0.0" {
+		return nil, 0, errProtoMsgUnsupported
+	}
+
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, string(body))
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, string(body))
+
+		// 5xx and 429 are transient, any other 4xx means the data will never be accepted
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return nil, 0, &recoverableError{
+				err:        err,
+				statusCode: resp.StatusCode,
+				retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+			}
+		}
+		return nil, 0, err
 	}
 
-	return nil
+	return resp, len(compressed), nil
+}
+
+func countSamples(batch []bridgeSeries) int {
+	n := 0
+	for _, s := range batch {
+		n += len(s.Samples)
+	}
+	return n
 }
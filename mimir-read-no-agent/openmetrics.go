@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/textparse"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// openMetricsSuffixes are the sample name suffixes OpenMetrics adds to a family name
+var openMetricsSuffixes = []string{"_total", "_created", "_bucket", "_count", "_sum", "_gcount", "_gsum", "_info"}
+
+// parseOpenMetrics decodes an OpenMetrics text exposition into metric families
+// keyed by their OpenMetrics family name.
+// The Prometheus parser yields flat samples, so they are grouped back into
+// families and metrics: _created becomes the created timestamp, _bucket, _count
+// and _sum fill histograms and summaries, and exemplars are kept on counters
+// and buckets.
+func parseOpenMetrics(body []byte) (map[string]*io_prometheus_client.MetricFamily, error) {
+	p := textparse.NewOpenMetricsParser(body, labels.NewSymbolTable())
+
+	types := make(map[string]model.MetricType)
+	helps := make(map[string]string)
+	units := make(map[string]string)
+
+	families := make(map[string]*io_prometheus_client.MetricFamily)
+	metrics := make(map[string]*io_prometheus_client.Metric)
+
+	for {
+		entry, err := p.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse openmetrics: %w", err)
+		}
+
+		switch entry {
+		case textparse.EntryType:
+			name, typ := p.Type()
+			types[string(name)] = typ
+			continue
+		case textparse.EntryHelp:
+			name, help := p.Help()
+			helps[string(name)] = string(help)
+			continue
+		case textparse.EntryUnit:
+			name, unit := p.Unit()
+			units[string(name)] = string(unit)
+			continue
+		case textparse.EntrySeries:
+		default:
+			continue
+		}
+
+		_, ts, value := p.Series()
+		var lset labels.Labels
+		p.Metric(&lset)
+
+		name := lset.Get(model.MetricNameLabel)
+		familyName, suffix := openMetricsFamily(name, types)
+		typ := types[familyName]
+
+		// Info and stateset samples are plain gauges once ingested
+		if typ == model.MetricTypeInfo || typ == model.MetricTypeStateset {
+			familyName, suffix, typ = name, "", model.MetricTypeGauge
+		}
+
+		mf, ok := families[familyName]
+		if !ok {
+			// Counters keep their _total suffix, as in the Prometheus text format
+			mfName := familyName
+			if typ == model.MetricTypeCounter {
+				mfName += "_total"
+			}
+			mf = &io_prometheus_client.MetricFamily{
+				Name: proto.String(mfName),
+				Type: dtoMetricType(typ).Enum(),
+			}
+			if help, ok := helps[familyName]; ok {
+				mf.Help = proto.String(help)
+			}
+			if unit, ok := units[familyName]; ok && unit != "" {
+				mf.Unit = proto.String(unit)
+			}
+			families[familyName] = mf
+		}
+
+		// Samples of one metric share their labels apart from le and quantile
+		key, metricLabels := openMetricsKey(familyName, lset)
+		metric, ok := metrics[key]
+		if !ok {
+			metric = &io_prometheus_client.Metric{Label: metricLabels}
+			metrics[key] = metric
+			mf.Metric = append(mf.Metric, metric)
+		}
+		if ts != nil && suffix != "_created" {
+			metric.TimestampMs = proto.Int64(*ts)
+		}
+
+		var ex *io_prometheus_client.Exemplar
+		var e exemplar.Exemplar
+		if p.Exemplar(&e) {
+			ex = dtoExemplar(e)
+		}
+
+		if err := setOpenMetricsSample(metric, mf.GetType(), suffix, lset, value, ex); err != nil {
+			return nil, fmt.Errorf("failed to parse openmetrics sample %s: %w", name, err)
+		}
+	}
+
+	return families, nil
+}
+
+// openMetricsFamily finds the family a sample belongs to and the suffix that was added to its name
+func openMetricsFamily(name string, types map[string]model.MetricType) (string, string) {
+	if typ, ok := types[name]; ok && typ != model.MetricTypeCounter && typ != model.MetricTypeInfo {
+		return name, ""
+	}
+
+	for _, suffix := range openMetricsSuffixes {
+		if family := strings.TrimSuffix(name, suffix); family != name {
+			if _, ok := types[family]; ok {
+				return family, suffix
+			}
+		}
+	}
+
+	return name, ""
+}
+
+// openMetricsKey identifies the metric a sample belongs to within its family
+func openMetricsKey(family string, lset labels.Labels) (string, []*io_prometheus_client.LabelPair) {
+	var key strings.Builder
+	key.WriteString(family)
+
+	var pairs []*io_prometheus_client.LabelPair
+	lset.Range(func(l labels.Label) {
+		if l.Name == model.MetricNameLabel || l.Name == model.BucketLabel || l.Name == model.QuantileLabel {
+			return
+		}
+		key.WriteString("\xff" + l.Name + "\xff" + l.Value)
+		pairs = append(pairs, &io_prometheus_client.LabelPair{Name: proto.String(l.Name), Value: proto.String(l.Value)})
+	})
+
+	return key.String(), pairs
+}
+
+// setOpenMetricsSample stores one sample value in its place within the metric
+func setOpenMetricsSample(metric *io_prometheus_client.Metric, typ io_prometheus_client.MetricType, suffix string, lset labels.Labels, value float64, ex *io_prometheus_client.Exemplar) error {
+	created := timestamppb.New(model.TimeFromUnixNano(int64(value * 1e9)).Time())
+
+	switch typ {
+	case io_prometheus_client.MetricType_COUNTER:
+		if metric.Counter == nil {
+			metric.Counter = &io_prometheus_client.Counter{}
+		}
+		if suffix == "_created" {
+			metric.Counter.CreatedTimestamp = created
+			return nil
+		}
+		metric.Counter.Value = proto.Float64(value)
+		if ex != nil {
+			metric.Counter.Exemplar = ex
+		}
+
+	case io_prometheus_client.MetricType_GAUGE:
+		metric.Gauge = &io_prometheus_client.Gauge{Value: proto.Float64(value)}
+
+	case io_prometheus_client.MetricType_SUMMARY:
+		if metric.Summary == nil {
+			metric.Summary = &io_prometheus_client.Summary{}
+		}
+		switch suffix {
+		case "_created":
+			metric.Summary.CreatedTimestamp = created
+		case "_count":
+			metric.Summary.SampleCount = proto.Uint64(uint64(value))
+		case "_sum":
+			metric.Summary.SampleSum = proto.Float64(value)
+		default:
+			q, err := strconv.ParseFloat(lset.Get(model.QuantileLabel), 64)
+			if err != nil {
+				return fmt.Errorf("invalid quantile: %w", err)
+			}
+			metric.Summary.Quantile = append(metric.Summary.Quantile, &io_prometheus_client.Quantile{
+				Quantile: proto.Float64(q),
+				Value:    proto.Float64(value),
+			})
+		}
+
+	case io_prometheus_client.MetricType_HISTOGRAM, io_prometheus_client.MetricType_GAUGE_HISTOGRAM:
+		if metric.Histogram == nil {
+			metric.Histogram = &io_prometheus_client.Histogram{}
+		}
+		h := metric.Histogram
+		switch suffix {
+		case "_created":
+			h.CreatedTimestamp = created
+		case "_count", "_gcount":
+			if value == math.Trunc(value) {
+				h.SampleCount = proto.Uint64(uint64(value))
+			} else {
+				h.SampleCountFloat = proto.Float64(value)
+			}
+		case "_sum", "_gsum":
+			h.SampleSum = proto.Float64(value)
+		case "_bucket":
+			le, err := strconv.ParseFloat(lset.Get(model.BucketLabel), 64)
+			if err != nil {
+				return fmt.Errorf("invalid le: %w", err)
+			}
+			bucket := &io_prometheus_client.Bucket{UpperBound: proto.Float64(le), Exemplar: ex}
+			if value == math.Trunc(value) {
+				bucket.CumulativeCount = proto.Uint64(uint64(value))
+			} else {
+				bucket.CumulativeCountFloat = proto.Float64(value)
+			}
+			h.Bucket = append(h.Bucket, bucket)
+		}
+
+	default:
+		metric.Untyped = &io_prometheus_client.Untyped{Value: proto.Float64(value)}
+	}
+
+	return nil
+}
+
+func dtoMetricType(typ model.MetricType) io_prometheus_client.MetricType {
+	switch typ {
+	case model.MetricTypeCounter:
+		return io_prometheus_client.MetricType_COUNTER
+	case model.MetricTypeGauge:
+		return io_prometheus_client.MetricType_GAUGE
+	case model.MetricTypeSummary:
+		return io_prometheus_client.MetricType_SUMMARY
+	case model.MetricTypeHistogram:
+		return io_prometheus_client.MetricType_HISTOGRAM
+	case model.MetricTypeGaugeHistogram:
+		return io_prometheus_client.MetricType_GAUGE_HISTOGRAM
+	default:
+		return io_prometheus_client.MetricType_UNTYPED
+	}
+}
+
+func dtoExemplar(e exemplar.Exemplar) *io_prometheus_client.Exemplar {
+	ex := &io_prometheus_client.Exemplar{Value: proto.Float64(e.Value)}
+	e.Labels.Range(func(l labels.Label) {
+		ex.Label = append(ex.Label, &io_prometheus_client.LabelPair{Name: proto.String(l.Name), Value: proto.String(l.Value)})
+	})
+	if e.HasTs {
+		ex.Timestamp = timestamppb.New(model.Time(e.Ts).Time())
+	}
+	return ex
+}
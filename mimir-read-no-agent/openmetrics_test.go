@@ -0,0 +1,179 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const testOpenMetrics = `# TYPE requests counter
+# HELP requests Requests served.
+requests_total{code="200"} 5 # {trace_id="abc"} 1 1.5
+requests_created{code="200"} 1700000000
+# TYPE build info
+build_info{version="1.2"} 1
+# TYPE feature stateset
+feature{feature="a"} 1
+feature{feature="b"} 0
+# TYPE latency_seconds histogram
+# UNIT latency_seconds seconds
+latency_seconds_bucket{le="0.1"} 1 # {trace_id="def"} 0.05
+latency_seconds_bucket{le="1"} 3
+latency_seconds_bucket{le="+Inf"} 4
+latency_seconds_count 4
+latency_seconds_sum 2.5
+latency_seconds_created 1700000000
+# TYPE rpc_seconds summary
+rpc_seconds{quantile="0.5"} 0.2
+rpc_seconds{quantile="0.9"} 0.7
+rpc_seconds_count 10
+rpc_seconds_sum 3
+# TYPE queue_size gaugehistogram
+queue_size_bucket{le="10"} 2
+queue_size_bucket{le="+Inf"} 3
+queue_size_gcount 3
+queue_size_gsum 17
+# EOF
+`
+
+func TestParseOpenMetrics(t *testing.T) {
+	families, err := parseOpenMetrics([]byte(testOpenMetrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for name := range families {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	want := []string{"build_info", "feature", "latency_seconds", "queue_size", "requests", "rpc_seconds"}
+	if !slices.Equal(names, want) {
+		t.Fatalf("got families %v, want %v", names, want)
+	}
+
+	requests := families["requests"]
+	if requests.GetName() != "requests_total" || requests.GetType() != io_prometheus_client.MetricType_COUNTER || requests.GetHelp() != "Requests served." {
+		t.Errorf("got counter family %v", requests)
+	}
+	if len(requests.Metric) != 1 {
+		t.Fatalf("got %d counter metrics, want _total and _created grouped into 1", len(requests.Metric))
+	}
+	counter := requests.Metric[0].GetCounter()
+	if counter.GetValue() != 5 || counter.GetCreatedTimestamp().AsTime().Unix() != 1700000000 {
+		t.Errorf("got counter %v", counter)
+	}
+	if ex := counter.GetExemplar(); ex.GetValue() != 1 || ex.GetTimestamp().AsTime().UnixMilli() != 1500 || ex.GetLabel()[0].GetValue() != "abc" {
+		t.Errorf("got exemplar %v", ex)
+	}
+
+	if build := families["build_info"]; build.GetType() != io_prometheus_client.MetricType_GAUGE || build.Metric[0].GetGauge().GetValue() != 1 {
+		t.Errorf("got info family %v, want a gauge", build)
+	}
+	if feature := families["feature"]; feature.GetType() != io_prometheus_client.MetricType_GAUGE || len(feature.Metric) != 2 {
+		t.Errorf("got stateset family %v, want a gauge per state", feature)
+	}
+
+	latency := families["latency_seconds"]
+	if len(latency.Metric) != 1 || latency.GetUnit() != "seconds" {
+		t.Fatalf("got histogram family %v", latency)
+	}
+	h := latency.Metric[0].GetHistogram()
+	if len(h.GetBucket()) != 3 || h.GetSampleCount() != 4 || h.GetSampleSum() != 2.5 || h.GetCreatedTimestamp() == nil {
+		t.Errorf("got histogram %v", h)
+	}
+	if h.GetBucket()[0].GetExemplar().GetValue() != 0.05 {
+		t.Errorf("got bucket exemplar %v", h.GetBucket()[0].GetExemplar())
+	}
+
+	s := families["rpc_seconds"].Metric[0].GetSummary()
+	if len(s.GetQuantile()) != 2 || s.GetSampleCount() != 10 || s.GetSampleSum() != 3 {
+		t.Errorf("got summary %v", s)
+	}
+
+	queue := families["queue_size"]
+	g := queue.Metric[0].GetHistogram()
+	if queue.GetType() != io_prometheus_client.MetricType_GAUGE_HISTOGRAM || len(g.GetBucket()) != 2 || g.GetSampleCount() != 3 || g.GetSampleSum() != 17 {
+		t.Errorf("got gauge histogram %v", queue)
+	}
+}
+
+func TestConvertOpenMetrics(t *testing.T) {
+	families, err := parseOpenMetrics([]byte(testOpenMetrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	series, err := convertToTimeseries(families, []prompb.Label{{Name: "job", Value: "test"}}, 1000, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]bridgeSeries)
+	for _, s := range series {
+		key := labelValue(s.Labels, model.MetricNameLabel)
+		for _, l := range []string{model.BucketLabel, model.QuantileLabel, "feature"} {
+			if v := labelValue(s.Labels, l); v != "" {
+				key += "{" + v + "}"
+			}
+		}
+		got[key] = s
+	}
+
+	for _, name := range []string{"requests_total", "latency_seconds_count"} {
+		if created := got[name].CreatedTimestamp; created != 1700000000000 {
+			t.Errorf("%s: got created timestamp %d, want 1700000000000", name, created)
+		}
+	}
+	if ex := got["requests_total"].Exemplars; len(ex) != 1 || ex[0].Value != 1 || ex[0].Timestamp != 1500 {
+		t.Errorf("got counter exemplars %v", ex)
+	}
+	if ex := got["latency_seconds_bucket{0.1}"].Exemplars; len(ex) != 1 || ex[0].Value != 0.05 {
+		t.Errorf("got bucket exemplars %v", ex)
+	}
+
+	for _, tc := range []struct {
+		name, family string
+		typ          prompb.MetricMetadata_MetricType
+		value        float64
+	}{
+		{"requests_total", "requests", prompb.MetricMetadata_COUNTER, 5},
+		{"build_info", "build_info", prompb.MetricMetadata_GAUGE, 1},
+		{"feature{a}", "feature", prompb.MetricMetadata_GAUGE, 1},
+		{"feature{b}", "feature", prompb.MetricMetadata_GAUGE, 0},
+		{"latency_seconds_bucket{0.1}", "latency_seconds", prompb.MetricMetadata_HISTOGRAM, 1},
+		{"latency_seconds_bucket{1}", "latency_seconds", prompb.MetricMetadata_HISTOGRAM, 3},
+		{"latency_seconds_bucket{+Inf}", "latency_seconds", prompb.MetricMetadata_HISTOGRAM, 4},
+		{"latency_seconds_count", "latency_seconds", prompb.MetricMetadata_HISTOGRAM, 4},
+		{"latency_seconds_sum", "latency_seconds", prompb.MetricMetadata_HISTOGRAM, 2.5},
+		{"rpc_seconds{0.5}", "rpc_seconds", prompb.MetricMetadata_SUMMARY, 0.2},
+		{"rpc_seconds{0.9}", "rpc_seconds", prompb.MetricMetadata_SUMMARY, 0.7},
+		{"rpc_seconds_count", "rpc_seconds", prompb.MetricMetadata_SUMMARY, 10},
+		{"rpc_seconds_sum", "rpc_seconds", prompb.MetricMetadata_SUMMARY, 3},
+		{"queue_size_bucket{10}", "queue_size", prompb.MetricMetadata_GAUGEHISTOGRAM, 2},
+		{"queue_size_bucket{+Inf}", "queue_size", prompb.MetricMetadata_GAUGEHISTOGRAM, 3},
+		{"queue_size_gcount", "queue_size", prompb.MetricMetadata_GAUGEHISTOGRAM, 3},
+		{"queue_size_gsum", "queue_size", prompb.MetricMetadata_GAUGEHISTOGRAM, 17},
+	} {
+		s, ok := got[tc.name]
+		if !ok {
+			t.Errorf("%s: missing", tc.name)
+			continue
+		}
+		delete(got, tc.name)
+		if s.Samples[0].Value != tc.value || s.Samples[0].Timestamp != 1000 {
+			t.Errorf("%s: got %v, want %v at 1000", tc.name, s.Samples[0], tc.value)
+		}
+		if s.Metadata.MetricFamilyName != tc.family || s.Metadata.Type != tc.typ {
+			t.Errorf("%s: got metadata %+v, want family %s of type %v", tc.name, s.Metadata, tc.family, tc.typ)
+		}
+		if labelValue(s.Labels, "job") != "test" {
+			t.Errorf("%s: target labels not added: %v", tc.name, s.Labels)
+		}
+	}
+	for name := range got {
+		t.Errorf("unexpected series %s", name)
+	}
+}
@@ -2,11 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"time"
+
+	config_util "github.com/prometheus/common/config"
 )
 
 const mimirQueryURL = "http://localhost:9009/prometheus/api/v1"
@@ -34,9 +38,15 @@ type RangeQueryResponse struct {
 }
 
 func main() {
-	client := &http.Client{Timeout: 10 * time.Second}
+	httpConfigFile := flag.String("http.config.file", "", "Path to a YAML file with basic_auth, authorization, http_headers and tls_config for the Mimir read path")
+	flag.Parse()
+
+	client, err := newClient(*httpConfigFile)
+	if err != nil {
+		log.Fatalf("Error creating HTTP client: %v", err)
+	}
 
-	fmt.Println("=== Mimir Query Demo ===\n")
+	fmt.Print("=== Mimir Query Demo ===\n\n")
 
 	// List all available metrics
 	fmt.Println("1. Listing all available metrics...")
@@ -140,15 +150,50 @@ func main() {
 	fmt.Println("  - last_metric_update_timestamp_seconds")
 }
 
+// newClient builds the HTTP client from an optional Prometheus style HTTP
+// client config file. Credential files are read on every request, so rotated
+// tokens and certificates are picked up without a restart.
+func newClient(configFile string) (*http.Client, error) {
+	cfg := config_util.DefaultHTTPClientConfig
+	if configFile != "" {
+		loaded, _, err := config_util.LoadHTTPConfigFile(configFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg = *loaded
+	}
+
+	client, err := config_util.NewClientFromConfig(cfg, "query-client")
+	if err != nil {
+		return nil, err
+	}
+	client.Timeout = 10 * time.Second
+
+	return client, nil
+}
+
+// checkStatus turns non-200 responses, e.g. a 401 from an authenticating gateway, into errors
+func checkStatus(resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, string(body))
+}
+
 func listMetrics(client *http.Client) ([]string, error) {
 	url := fmt.Sprintf("%s/label/__name__/values", mimirQueryURL)
-	
+
 	resp, err := client.Get(url)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
+
 	var result struct {
 		Status string   `json:"status"`
 		Data   []string `json:"data"`
@@ -181,15 +226,19 @@ func queryInstant(client *http.Client, query string) (interface{}, error) {
 func queryInstantFull(client *http.Client, query string) (*QueryResponse, error) {
 	params := url.Values{}
 	params.Add("query", query)
-	
+
 	queryURL := fmt.Sprintf("%s/query?%s", mimirQueryURL, params.Encode())
-	
+
 	resp, err := client.Get(queryURL)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
+
 	var result QueryResponse
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 		return nil, err
@@ -220,6 +269,10 @@ func queryRange(client *http.Client, query string, duration time.Duration, step
 	}
 	defer resp.Body.Close()
 
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
+
 	var result RangeQueryResponse
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 		return nil, err
@@ -0,0 +1,638 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const reshardInterval = 10 * time.Second
+
+// recoverableError marks a push failure worth retrying: network errors, 5xx
+// and 429 responses. Other 4xx responses mean Mimir will never accept the data.
+type recoverableError struct {
+	err        error
+	statusCode int
+	retryAfter time.Duration
+}
+
+func (e *recoverableError) Error() string { return e.err.Error() }
+func (e *recoverableError) Unwrap() error { return e.err }
+
+// walRecord tracks how many of a WAL record's samples are still in flight.
+// The record is removed from disk once every batch holding one of them is done.
+type walRecord struct {
+	seq       uint64
+	created   time.Time
+	remaining atomic.Int64
+}
+
+// backlogRecord is a WAL record waiting for room in the shards. series is
+// nil if the record has to be read back from the WAL.
+type backlogRecord struct {
+	seq     uint64
+	created time.Time
+	series  []bridgeSeries
+}
+
+// queuedSeries is a single sample or histogram waiting in a shard
+type queuedSeries struct {
+	series bridgeSeries
+	record *walRecord
+}
+
+// queueManager splits write requests into per-series samples, hashes them
+// onto shards and sends each shard's batches in parallel. Modeled on Alloy's
+// queue_config: a series always lands on the same shard, so its samples reach
+// Mimir in order, and the number of shards follows the ingestion rate between
+// min_shards and max_shards.
+type queueManager struct {
+	client *http.Client
+	name   string
+	url    string
+	tenant string
+	cfg    QueueConfig
+	wal    *wal
+	maxAge time.Duration
+
+	// metadata is nil unless metadata_config.send is set
+	metadataCfg MetadataConfig
+	metadata    *metadataStore
+
+	// protoMsg is the remote write message in use, it falls back to 1.0
+	// when the receiver rejects 2.0
+	protoMsg atomic.Value
+
+	shardsMu  sync.RWMutex
+	shards    []chan queuedSeries
+	shardsWg  sync.WaitGroup
+	numShards int
+	stopped   bool
+
+	// backlog holds the records written to the WAL that the feeder has not
+	// handed to the shards yet, so writes do not block while the shards are
+	// full because the endpoint is down. Once the backlog holds as many
+	// samples as one shard's capacity, further records are only kept on disk
+	// and read back when their turn comes.
+	backlogMu      sync.Mutex
+	backlog        []backlogRecord
+	backlogSamples int
+	closing        bool
+	backlogReady   chan struct{}
+	feederDone     chan struct{}
+
+	// ctx is cancelled to abort sends, including the push in flight
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	samplesIn    atomic.Int64
+	samplesOut   atomic.Int64
+	samplesQueue atomic.Int64
+	sendNanos    atomic.Int64
+	bytesSent    atomic.Int64
+}
+
+// newQueueManager opens the WAL and queues any records left over from a previous run
+func newQueueManager(client *http.Client, rw RemoteWriteConfig, walCfg WALConfig, tenant string) (*queueManager, error) {
+	w, err := openWAL(walCfg.Directory)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &queueManager{
+		client: client,
+		name:   rw.Name,
+		url:    rw.URL,
+		tenant: tenant,
+		cfg:    rw.QueueConfig,
+		wal:    w,
+		maxAge: time.Duration(walCfg.MaxAge),
+
+		metadataCfg: rw.MetadataConfig,
+
+		backlogReady: make(chan struct{}, 1),
+		feederDone:   make(chan struct{}),
+	}
+	if rw.MetadataConfig.Send {
+		q.metadata = newMetadataStore()
+	}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	q.protoMsg.Store(rw.ProtobufMessage)
+
+	seqs, err := w.pending()
+	if err != nil {
+		return nil, err
+	}
+	if len(seqs) > 0 {
+		log.Printf("Replaying %d write requests from WAL %s\n", len(seqs), walCfg.Directory)
+	}
+
+	q.startShards(rw.QueueConfig.MinShards)
+
+	// Replayed records go through the backlog like new ones and are read
+	// back when their turn comes, so a WAL larger than the shards can hold
+	// does not block startup while the endpoint is down
+	for _, seq := range seqs {
+		created := time.Now()
+		if info, err := os.Stat(w.path(seq)); err == nil {
+			created = info.ModTime()
+		}
+		q.backlog = append(q.backlog, backlogRecord{seq: seq, created: created})
+	}
+
+	if size, err := w.size(); err == nil {
+		walSizeBytes.WithLabelValues(q.name, q.url, tenant).Set(float64(size))
+	}
+
+	go q.feed()
+
+	return q, nil
+}
+
+// enqueue writes the series to the WAL and queues them for the shards
+func (q *queueManager) enqueue(timeseries []bridgeSeries) error {
+	seq, err := q.wal.append(toWALRequest(timeseries))
+	if err != nil {
+		return err
+	}
+
+	q.backlogMu.Lock()
+	record := backlogRecord{seq: seq, created: time.Now()}
+	if q.backlogSamples < q.cfg.Capacity {
+		record.series = timeseries
+		q.backlogSamples += sampleCount(timeseries)
+	}
+	q.backlog = append(q.backlog, record)
+	q.backlogMu.Unlock()
+
+	select {
+	case q.backlogReady <- struct{}{}:
+	default:
+	}
+
+	if q.metadata != nil {
+		q.metadata.observe(timeseries)
+	}
+	return nil
+}
+
+// feed hands the backlog to the shards in order until the queue is aborted,
+// or drained and the backlog is empty
+func (q *queueManager) feed() {
+	defer close(q.feederDone)
+
+	for {
+		q.backlogMu.Lock()
+		if len(q.backlog) == 0 {
+			closing := q.closing
+			q.backlogMu.Unlock()
+			if closing {
+				return
+			}
+
+			select {
+			case <-q.ctx.Done():
+				return
+			case <-q.backlogReady:
+			}
+			continue
+		}
+
+		record := q.backlog[0]
+		q.backlog[0] = backlogRecord{}
+		q.backlog = q.backlog[1:]
+		q.backlogSamples -= sampleCount(record.series)
+		q.backlogMu.Unlock()
+
+		if q.ctx.Err() != nil {
+			return
+		}
+
+		series := record.series
+		if series == nil {
+			req, err := q.wal.read(record.seq)
+			if err != nil {
+				log.Printf("Dropping WAL record: %v\n", err)
+				q.wal.remove(record.seq)
+				continue
+			}
+			series = fromV2Request(req)
+		}
+		q.append(&walRecord{seq: record.seq, created: record.created}, series)
+	}
+}
+
+// sampleCount returns the number of samples and histograms in the series
+func sampleCount(series []bridgeSeries) int {
+	n := 0
+	for _, s := range series {
+		n += len(s.Samples) + len(s.Histograms)
+	}
+	return n
+}
+
+// append splits the series of a record into one entry per sample and queues
+// them on their shards, blocking while a shard is at capacity
+func (q *queueManager) append(record *walRecord, timeseries []bridgeSeries) {
+	var entries []queuedSeries
+	for _, ts := range timeseries {
+		single := func(t prompb.TimeSeries) queuedSeries {
+			return queuedSeries{
+				series: bridgeSeries{TimeSeries: t, CreatedTimestamp: ts.CreatedTimestamp, Metadata: ts.Metadata},
+				record: record,
+			}
+		}
+
+		for _, s := range ts.Samples {
+			entries = append(entries, single(prompb.TimeSeries{Labels: ts.Labels, Samples: []prompb.Sample{s}}))
+		}
+		for _, h := range ts.Histograms {
+			entries = append(entries, single(prompb.TimeSeries{Labels: ts.Labels, Histograms: []prompb.Histogram{h}}))
+		}
+
+		// Exemplars travel with the first sample of their series
+		if len(ts.Exemplars) > 0 {
+			if n := len(ts.Samples) + len(ts.Histograms); n > 0 {
+				entries[len(entries)-n].series.Exemplars = ts.Exemplars
+			}
+		}
+	}
+
+	if len(entries) == 0 {
+		q.wal.remove(record.seq)
+		return
+	}
+
+	record.remaining.Store(int64(len(entries)))
+	q.samplesIn.Add(int64(len(entries)))
+	q.samplesQueue.Add(int64(len(entries)))
+	samplesPending.WithLabelValues(q.name, q.url, q.tenant).Add(float64(len(entries)))
+
+	q.shardsMu.RLock()
+	defer q.shardsMu.RUnlock()
+
+	// The record stays in the WAL and is replayed by the queue that replaces this one
+	if q.stopped {
+		q.samplesQueue.Add(-int64(len(entries)))
+		samplesPending.WithLabelValues(q.name, q.url, q.tenant).Sub(float64(len(entries)))
+		return
+	}
+
+	for _, e := range entries {
+		q.shards[shardFor(e.series.Labels, len(q.shards))] <- e
+	}
+}
+
+// pendingSamples returns the number of samples queued or in flight
+func (q *queueManager) pendingSamples() int64 {
+	return q.samplesQueue.Load()
+}
+
+// run periodically adjusts the number of shards to the observed ingestion and send rates
+func (q *queueManager) run() {
+	ticker := time.NewTicker(reshardInterval)
+	defer ticker.Stop()
+
+	var lastIn, lastOut, lastNanos, lastBytes int64
+	for {
+		select {
+		case <-q.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		in, out, nanos, sent := q.samplesIn.Load(), q.samplesOut.Load(), q.sendNanos.Load(), q.bytesSent.Load()
+		desired := q.desiredShards(in-lastIn, out-lastOut, nanos-lastNanos)
+
+		if sent > lastBytes {
+			log.Printf("Remote write%s sent %d samples in %d bytes over the last %v using %s\n",
+				q.logTenant(), out-lastOut, sent-lastBytes, reshardInterval, q.protoMsg.Load())
+		}
+		lastIn, lastOut, lastNanos, lastBytes = in, out, nanos, sent
+
+		if size, err := q.wal.size(); err == nil {
+			walSizeBytes.WithLabelValues(q.name, q.url, q.tenant).Set(float64(size))
+		}
+
+		q.shardsMu.RLock()
+		current := q.numShards
+		q.shardsMu.RUnlock()
+
+		// Ignore small changes so shards are not restarted on every tick
+		if desired == current || math.Abs(float64(desired-current)) < 0.3*float64(current) {
+			continue
+		}
+
+		log.Printf("Resharding remote write queue%s from %d to %d shards\n", q.logTenant(), current, desired)
+		q.reshard(desired)
+	}
+}
+
+// desiredShards estimates how many parallel senders are needed to keep up
+// with the incoming samples plus the current backlog
+func (q *queueManager) desiredShards(samplesIn, samplesOut, sendNanos int64) int {
+	q.shardsMu.RLock()
+	current := q.numShards
+	q.shardsMu.RUnlock()
+
+	// Nothing was sent, e.g. Mimir is down; more shards would not help
+	if samplesOut == 0 {
+		return current
+	}
+
+	interval := reshardInterval.Seconds()
+	timePerSample := float64(sendNanos) / float64(samplesOut) / float64(time.Second)
+	rate := float64(samplesIn)/interval + float64(q.pendingSamples())/interval
+
+	desired := int(math.Ceil(rate * timePerSample))
+	if desired < q.cfg.MinShards {
+		desired = q.cfg.MinShards
+	}
+	if desired > q.cfg.MaxShards {
+		desired = q.cfg.MaxShards
+	}
+	return desired
+}
+
+// reshard stops the current shards once they have sent everything they hold
+// and starts n new ones. Draining first keeps per-series ordering intact.
+func (q *queueManager) reshard(n int) {
+	q.shardsMu.Lock()
+	defer q.shardsMu.Unlock()
+
+	if q.stopped {
+		return
+	}
+
+	for _, shard := range q.shards {
+		close(shard)
+	}
+	q.shardsWg.Wait()
+
+	q.startShardsLocked(n)
+}
+
+// abort makes the shards give up on their current and queued batches. Their
+// samples are not acknowledged, so they stay in the WAL.
+func (q *queueManager) abort() {
+	q.cancel()
+}
+
+// stop aborts sending and waits for the shards to exit. Records that were
+// not sent are left in the WAL for the next queue on the same directory.
+func (q *queueManager) stop() {
+	q.abort()
+	q.drain(context.Background())
+}
+
+// drain stops accepting samples and waits for the backlog and the shards to
+// be sent. Once ctx is done the remaining sends are aborted and left in the WAL.
+func (q *queueManager) drain(ctx context.Context) {
+	q.backlogMu.Lock()
+	q.closing = true
+	q.backlogMu.Unlock()
+	select {
+	case q.backlogReady <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-q.feederDone:
+	case <-ctx.Done():
+		q.backlogMu.Lock()
+		backlog := len(q.backlog)
+		q.backlogMu.Unlock()
+		log.Printf("Remote write%s did not drain in time, %d write requests stay in the WAL\n", q.logTenant(), backlog)
+		q.abort()
+		<-q.feederDone
+	}
+
+	q.shardsMu.Lock()
+	defer q.shardsMu.Unlock()
+
+	if q.stopped {
+		return
+	}
+	q.stopped = true
+	for _, shard := range q.shards {
+		close(shard)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		q.shardsWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("Remote write%s did not drain in time, %d samples stay in the WAL\n", q.logTenant(), q.pendingSamples())
+		q.abort()
+		<-done
+	}
+}
+
+func (q *queueManager) startShards(n int) {
+	q.shardsMu.Lock()
+	defer q.shardsMu.Unlock()
+	q.startShardsLocked(n)
+}
+
+func (q *queueManager) startShardsLocked(n int) {
+	q.numShards = n
+	shardsCount.WithLabelValues(q.name, q.url, q.tenant).Set(float64(n))
+	q.shards = make([]chan queuedSeries, n)
+	for i := range q.shards {
+		q.shards[i] = make(chan queuedSeries, q.cfg.Capacity)
+		q.shardsWg.Add(1)
+		go q.runShard(q.shards[i])
+	}
+}
+
+// runShard batches samples until max_samples_per_send is reached or
+// batch_send_deadline passes, then sends the batch. It returns after
+// flushing once the shard is closed.
+func (q *queueManager) runShard(shard chan queuedSeries) {
+	defer q.shardsWg.Done()
+
+	deadline := time.Duration(q.cfg.BatchSendDeadline)
+	timer := time.NewTimer(deadline)
+	defer timer.Stop()
+
+	batch := make([]queuedSeries, 0, q.cfg.MaxSamplesPerSend)
+	flush := func() {
+		if len(batch) > 0 {
+			q.sendBatch(batch)
+			batch = batch[:0]
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(deadline)
+	}
+
+	for {
+		select {
+		case e, ok := <-shard:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) >= q.cfg.MaxSamplesPerSend {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+// sendBatch pushes a batch until it is accepted, rejected or too old, then
+// releases its samples from their WAL records. A batch aborted by stop is
+// not released.
+func (q *queueManager) sendBatch(batch []queuedSeries) {
+	aborted := false
+	defer func() {
+		q.samplesQueue.Add(-int64(len(batch)))
+		samplesPending.WithLabelValues(q.name, q.url, q.tenant).Sub(float64(len(batch)))
+		if aborted {
+			return
+		}
+		for _, e := range batch {
+			if e.record.remaining.Add(-1) == 0 {
+				if err := q.wal.remove(e.record.seq); err != nil {
+					log.Printf("Error removing WAL record: %v\n", err)
+				}
+			}
+		}
+	}()
+
+	timeseries := make([]bridgeSeries, len(batch))
+	oldest := time.Now()
+	for i, e := range batch {
+		timeseries[i] = e.series
+		if e.record.created.Before(oldest) {
+			oldest = e.record.created
+		}
+	}
+
+	backoff := time.Duration(q.cfg.MinBackoff)
+	for attempt := 1; ; attempt++ {
+		if q.ctx.Err() != nil {
+			aborted = true
+			return
+		}
+
+		start := time.Now()
+		protoMsg := q.protoMsg.Load().(string)
+		n, err := pushToMimir(q.ctx, q.client, q.url, q.tenant, timeseries, protoMsg)
+		sentBatchDuration.WithLabelValues(q.name, q.url, q.tenant).Observe(time.Since(start).Seconds())
+		if errors.Is(err, errProtoMsgUnsupported) {
+			if q.protoMsg.CompareAndSwap(protoMsg, remoteWriteProtoMsgV1) {
+				log.Printf("Receiver %s does not support %s, falling back to %s\n", q.url, protoMsg, remoteWriteProtoMsgV1)
+			}
+			continue
+		}
+		if err != nil && q.ctx.Err() != nil {
+			aborted = true
+			return
+		}
+		if err == nil {
+			q.samplesOut.Add(int64(len(batch)))
+			q.sendNanos.Add(int64(time.Since(start)))
+			q.bytesSent.Add(int64(n))
+			samplesSentTotal.WithLabelValues(q.name, q.url, q.tenant).Add(float64(len(batch)))
+			bytesSentTotal.WithLabelValues(q.name, q.url, q.tenant).Add(float64(n))
+			if attempt > 1 {
+				log.Printf("✓ Pushed %d samples after %d attempts\n", len(batch), attempt)
+			}
+			return
+		}
+
+		var rerr *recoverableError
+		if !errors.As(err, &rerr) || (rerr.statusCode == http.StatusTooManyRequests && !q.cfg.RetryOnRateLimit) {
+			log.Printf("Dropping %d samples rejected by %s: %v\n", len(batch), q.url, err)
+			samplesFailedTotal.WithLabelValues(q.name, q.url, q.tenant).Add(float64(len(batch)))
+			return
+		}
+
+		if q.maxAge > 0 && time.Since(oldest) > q.maxAge {
+			log.Printf("Dropping %d samples older than %v: %v\n", len(batch), q.maxAge, err)
+			samplesFailedTotal.WithLabelValues(q.name, q.url, q.tenant).Add(float64(len(batch)))
+			return
+		}
+
+		delay := backoff
+		if rerr.retryAfter > 0 {
+			delay = rerr.retryAfter
+		}
+		log.Printf("Error pushing to %s (attempt %d, retrying in %v): %v\n", q.url, attempt, delay, err)
+		samplesRetriedTotal.WithLabelValues(q.name, q.url, q.tenant).Add(float64(len(batch)))
+		select {
+		case <-q.ctx.Done():
+			aborted = true
+			return
+		case <-time.After(delay):
+		}
+
+		backoff *= 2
+		if backoff > time.Duration(q.cfg.MaxBackoff) {
+			backoff = time.Duration(q.cfg.MaxBackoff)
+		}
+	}
+}
+
+// logTenant names the tenant in log messages
+func (q *queueManager) logTenant() string {
+	if q.tenant == "" {
+		return ""
+	}
+	return " for tenant " + q.tenant
+}
+
+// shardFor picks the shard for a series from a hash of its labels
+func shardFor(labels []prompb.Label, n int) int {
+	h := fnv.New64a()
+	for _, l := range labels {
+		h.Write([]byte(l.Name))
+		h.Write([]byte{0xff})
+		h.Write([]byte(l.Value))
+		h.Write([]byte{0xff})
+	}
+	return int(h.Sum64() % uint64(n))
+}
+
+// parseRetryAfter reads a Retry-After header given either in seconds or as an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	var seconds int
+	if _, err := fmt.Sscanf(value, "%d", &seconds); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// testReceiver is a remote write 1.0 endpoint that records the samples it
+// accepts. respond picks the status of the n-th request, 1 based.
+type testReceiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests int
+	samples  map[string][]prompb.Sample
+	series   []receivedSeries
+	respond  func(n int, w http.ResponseWriter) int
+}
+
+// receivedSeries is a series accepted by a testReceiver with its X-Scope-OrgID
+type receivedSeries struct {
+	tenant string
+	prompb.TimeSeries
+}
+
+func newTestReceiver(t *testing.T) *testReceiver {
+	r := &testReceiver{samples: make(map[string][]prompb.Sample)}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *testReceiver) serve(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err := snappy.Decode(nil, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var wr prompb.WriteRequest
+	if err := proto.Unmarshal(data, &wr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.mu.Lock()
+	r.requests++
+	n, respond := r.requests, r.respond
+	r.mu.Unlock()
+
+	status := http.StatusNoContent
+	if respond != nil {
+		status = respond(n, w)
+	}
+	if status/100 == 2 {
+		r.mu.Lock()
+		for _, ts := range wr.Timeseries {
+			name := toLabels(ts.Labels).Get(model.MetricNameLabel)
+			r.samples[name] = append(r.samples[name], ts.Samples...)
+			r.series = append(r.series, receivedSeries{tenant: req.Header.Get("X-Scope-OrgID"), TimeSeries: ts})
+		}
+		r.mu.Unlock()
+	}
+	w.WriteHeader(status)
+}
+
+func (r *testReceiver) setRespond(respond func(n int, w http.ResponseWriter) int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.respond = respond
+}
+
+func (r *testReceiver) requestCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.requests
+}
+
+func (r *testReceiver) received() []receivedSeries {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.series)
+}
+
+func (r *testReceiver) sampleCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, s := range r.samples {
+		n += len(s)
+	}
+	return n
+}
+
+func testRemoteWriteConfig(url string) RemoteWriteConfig {
+	rw := defaultRemoteWriteConfig()
+	rw.URL = url
+	rw.MetadataConfig.Send = false
+	rw.QueueConfig.BatchSendDeadline = model.Duration(10 * time.Millisecond)
+	rw.QueueConfig.MinBackoff = model.Duration(time.Millisecond)
+	rw.QueueConfig.MaxBackoff = model.Duration(10 * time.Millisecond)
+	return rw
+}
+
+func newTestQueue(t *testing.T, rw RemoteWriteConfig, dir string) *queueManager {
+	q, err := newQueueManager(http.DefaultClient, rw, WALConfig{Directory: dir}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(q.stop)
+	return q
+}
+
+// newTestWriter starts a fan-out writer over the endpoints with its WAL in a
+// temporary directory
+func newTestWriter(t *testing.T, rws ...*RemoteWriteConfig) *fanoutWriter {
+	f, err := newFanoutWriter(rws, WALConfig{Directory: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		f.abort()
+		f.drain(context.Background())
+	})
+	return f
+}
+
+func drainWriter(t *testing.T, f *fanoutWriter) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	f.drain(ctx)
+	if ctx.Err() != nil {
+		t.Fatal("writer did not drain in time")
+	}
+}
+
+func drainQueue(t *testing.T, q *queueManager) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	q.drain(ctx)
+	if ctx.Err() != nil {
+		t.Fatal("queue did not drain in time")
+	}
+}
+
+func pendingRecords(t *testing.T, dir string) int {
+	seqs, err := (&wal{dir: dir}).pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(seqs)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestQueueSendsAndAcknowledges(t *testing.T) {
+	recv := newTestReceiver(t)
+	dir := t.TempDir()
+	q := newTestQueue(t, testRemoteWriteConfig(recv.URL), dir)
+
+	for i := range 5 {
+		if err := q.enqueue([]bridgeSeries{testSeries("a_total", int64(i), 1), testSeries("b_total", int64(i), 2)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	drainQueue(t, q)
+
+	if n := recv.sampleCount(); n != 10 {
+		t.Errorf("receiver got %d samples, want 10", n)
+	}
+	if n := pendingRecords(t, dir); n != 0 {
+		t.Errorf("%d records left in the WAL, want 0", n)
+	}
+	if n := q.pendingSamples(); n != 0 {
+		t.Errorf("%d samples still pending, want 0", n)
+	}
+}
+
+func TestQueueReplayAfterRestart(t *testing.T) {
+	// A separate receiver for each run, as the aborted push of the first
+	// may still be handled after the queue stopped
+	down := newTestReceiver(t)
+	down.setRespond(func(int, http.ResponseWriter) int { return http.StatusServiceUnavailable })
+	recv := newTestReceiver(t)
+	dir := t.TempDir()
+
+	q := newTestQueue(t, testRemoteWriteConfig(down.URL), dir)
+	if err := q.enqueue([]bridgeSeries{testSeries("a_total", 1, 1), testSeries("a_total", 2, 2)}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a failed push", func() bool { return down.requestCount() > 0 })
+	q.stop()
+
+	if n := pendingRecords(t, dir); n != 1 {
+		t.Fatalf("%d records in the WAL after stopping, want 1", n)
+	}
+
+	q = newTestQueue(t, testRemoteWriteConfig(recv.URL), dir)
+	drainQueue(t, q)
+
+	if got := recv.samples["a_total"]; len(got) != 2 || got[0].Timestamp != 1 || got[1].Timestamp != 2 {
+		t.Errorf("got replayed samples %v, want timestamps 1 and 2", got)
+	}
+	if n := pendingRecords(t, dir); n != 0 {
+		t.Errorf("%d records left in the WAL, want 0", n)
+	}
+}
+
+func TestQueueDropsCorruptRecordOnReplay(t *testing.T) {
+	recv := newTestReceiver(t)
+	dir := t.TempDir()
+
+	w, err := openWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt, err := w.append(toV2Request([]bridgeSeries{testSeries("corrupt_total", 1, 1)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.append(toV2Request([]bridgeSeries{testSeries("a_total", 2, 1)})); err != nil {
+		t.Fatal(err)
+	}
+	record, err := os.ReadFile(w.path(corrupt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	record[0] ^= 0xff
+	if err := os.WriteFile(w.path(corrupt), record, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	q := newTestQueue(t, testRemoteWriteConfig(recv.URL), dir)
+	drainQueue(t, q)
+
+	if got := recv.samples["corrupt_total"]; len(got) != 0 {
+		t.Errorf("corrupt record was sent: %v", got)
+	}
+	if got := recv.samples["a_total"]; len(got) != 1 {
+		t.Errorf("got %v for the intact record, want one sample", got)
+	}
+	if n := pendingRecords(t, dir); n != 0 {
+		t.Errorf("%d records left in the WAL, want 0", n)
+	}
+}
+
+func TestQueuePartialAck(t *testing.T) {
+	recv := newTestReceiver(t)
+	release := make(chan struct{})
+	var releaseOnce sync.Once
+	t.Cleanup(func() { releaseOnce.Do(func() { close(release) }) })
+	recv.setRespond(func(n int, w http.ResponseWriter) int {
+		if n > 1 {
+			<-release
+		}
+		return http.StatusNoContent
+	})
+	dir := t.TempDir()
+	rw := testRemoteWriteConfig(recv.URL)
+	rw.QueueConfig.MaxSamplesPerSend = 1
+
+	q := newTestQueue(t, rw, dir)
+	if err := q.enqueue([]bridgeSeries{testSeries("a_total", 1, 1), testSeries("b_total", 1, 1)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first sample is accepted while the second is still in flight
+	waitFor(t, "the second push", func() bool { return recv.requestCount() == 2 })
+	if n := recv.sampleCount(); n != 1 {
+		t.Fatalf("receiver got %d samples, want 1", n)
+	}
+	if n := pendingRecords(t, dir); n != 1 {
+		t.Errorf("%d records in the WAL with one sample unacknowledged, want 1", n)
+	}
+
+	releaseOnce.Do(func() { close(release) })
+	waitFor(t, "the record to be removed", func() bool { return pendingRecords(t, dir) == 0 })
+	if n := recv.sampleCount(); n != 2 {
+		t.Errorf("receiver got %d samples, want 2", n)
+	}
+}
+
+func TestQueueKeepsSeriesOrderAcrossShards(t *testing.T) {
+	recv := newTestReceiver(t)
+	rw := testRemoteWriteConfig(recv.URL)
+	rw.QueueConfig.MinShards = 4
+	rw.QueueConfig.MaxSamplesPerSend = 3
+
+	q := newTestQueue(t, rw, t.TempDir())
+	for i := range 50 {
+		var series []bridgeSeries
+		for s := range 10 {
+			series = append(series, testSeries(fmt.Sprintf("s%d_total", s), int64(i), float64(i)))
+		}
+		if err := q.enqueue(series); err != nil {
+			t.Fatal(err)
+		}
+	}
+	drainQueue(t, q)
+
+	for s := range 10 {
+		name := fmt.Sprintf("s%d_total", s)
+		got := recv.samples[name]
+		if len(got) != 50 {
+			t.Errorf("%s: got %d samples, want 50", name, len(got))
+			continue
+		}
+		for i, sample := range got {
+			if sample.Timestamp != int64(i) {
+				t.Errorf("%s: sample %d has timestamp %d, samples arrived out of order", name, i, sample.Timestamp)
+				break
+			}
+		}
+	}
+}
+
+func TestShardFor(t *testing.T) {
+	a := []prompb.Label{{Name: "__name__", Value: "a_total"}}
+	for n := 1; n <= 8; n++ {
+		shard := shardFor(a, n)
+		if shard < 0 || shard >= n {
+			t.Fatalf("shard %d out of range for %d shards", shard, n)
+		}
+		if again := shardFor(a, n); again != shard {
+			t.Errorf("same labels hashed to shards %d and %d", shard, again)
+		}
+	}
+}
+
+func TestQueueRetriesRecoverableErrors(t *testing.T) {
+	for _, status := range []int{http.StatusInternalServerError, http.StatusServiceUnavailable, http.StatusTooManyRequests} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			recv := newTestReceiver(t)
+			recv.setRespond(func(n int, w http.ResponseWriter) int {
+				if n <= 2 {
+					return status
+				}
+				return http.StatusNoContent
+			})
+			dir := t.TempDir()
+
+			q := newTestQueue(t, testRemoteWriteConfig(recv.URL), dir)
+			if err := q.enqueue([]bridgeSeries{testSeries("a_total", 1, 1)}); err != nil {
+				t.Fatal(err)
+			}
+			drainQueue(t, q)
+
+			if n := recv.requestCount(); n != 3 {
+				t.Errorf("got %d requests, want 3", n)
+			}
+			if n := recv.sampleCount(); n != 1 {
+				t.Errorf("receiver got %d samples, want 1", n)
+			}
+			if n := pendingRecords(t, dir); n != 0 {
+				t.Errorf("%d records left in the WAL, want 0", n)
+			}
+		})
+	}
+}
+
+func TestQueueHonorsRetryAfter(t *testing.T) {
+	recv := newTestReceiver(t)
+	var mu sync.Mutex
+	var times []time.Time
+	recv.setRespond(func(n int, w http.ResponseWriter) int {
+		mu.Lock()
+		times = append(times, time.Now())
+		mu.Unlock()
+		if n == 1 {
+			w.Header().Set("Retry-After", "1")
+			return http.StatusTooManyRequests
+		}
+		return http.StatusNoContent
+	})
+
+	q := newTestQueue(t, testRemoteWriteConfig(recv.URL), t.TempDir())
+	if err := q.enqueue([]bridgeSeries{testSeries("a_total", 1, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	drainQueue(t, q)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(times) != 2 {
+		t.Fatalf("got %d requests, want 2", len(times))
+	}
+	if d := times[1].Sub(times[0]); d < time.Second {
+		t.Errorf("retried after %v, want at least the Retry-After of 1s", d)
+	}
+}
+
+func TestQueueDropsRejectedSamples(t *testing.T) {
+	for _, status := range []int{http.StatusBadRequest, http.StatusNotFound} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			recv := newTestReceiver(t)
+			recv.setRespond(func(int, http.ResponseWriter) int { return status })
+			dir := t.TempDir()
+
+			q := newTestQueue(t, testRemoteWriteConfig(recv.URL), dir)
+			if err := q.enqueue([]bridgeSeries{testSeries("a_total", 1, 1)}); err != nil {
+				t.Fatal(err)
+			}
+			drainQueue(t, q)
+
+			if n := recv.requestCount(); n != 1 {
+				t.Errorf("got %d requests, want 1", n)
+			}
+			if n := pendingRecords(t, dir); n != 0 {
+				t.Errorf("%d records left in the WAL, want 0", n)
+			}
+		})
+	}
+}
+
+func TestQueueReplayLargerThanCapacity(t *testing.T) {
+	recv := newTestReceiver(t)
+	recv.setRespond(func(int, http.ResponseWriter) int { return http.StatusServiceUnavailable })
+	dir := t.TempDir()
+	rw := testRemoteWriteConfig(recv.URL)
+	rw.QueueConfig.Capacity = 2
+	rw.QueueConfig.MaxSamplesPerSend = 2
+
+	w, err := openWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 20 {
+		if _, err := w.append(toV2Request([]bridgeSeries{testSeries("a_total", int64(i), 1), testSeries("b_total", int64(i), 1)})); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Neither opening the queue nor writing to it waits for the endpoint
+	done := make(chan *queueManager)
+	go func() {
+		q, err := newQueueManager(http.DefaultClient, rw, WALConfig{Directory: dir}, "")
+		if err != nil {
+			t.Error(err)
+		}
+		for i := 20; i < 40; i++ {
+			if err := q.enqueue([]bridgeSeries{testSeries("a_total", int64(i), 1), testSeries("b_total", int64(i), 1)}); err != nil {
+				t.Error(err)
+			}
+		}
+		done <- q
+	}()
+
+	var q *queueManager
+	select {
+	case q = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("opening the queue blocked on a WAL larger than its capacity")
+	}
+	t.Cleanup(q.stop)
+
+	recv.setRespond(nil)
+	drainQueue(t, q)
+
+	for _, name := range []string{"a_total", "b_total"} {
+		got := recv.samples[name]
+		if len(got) != 40 {
+			t.Errorf("%s: got %d samples, want 40", name, len(got))
+			continue
+		}
+		for i, sample := range got {
+			if sample.Timestamp != int64(i) {
+				t.Errorf("%s: sample %d has timestamp %d, samples arrived out of order", name, i, sample.Timestamp)
+				break
+			}
+		}
+	}
+	if n := pendingRecords(t, dir); n != 0 {
+		t.Errorf("%d records left in the WAL, want 0", n)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"":        0,
+		"5":       5 * time.Second,
+		"-1":      0,
+		"invalid": 0,
+		time.Now().Add(time.Hour).UTC().Format(http.TimeFormat): time.Hour,
+	} {
+		got := parseRetryAfter(value)
+		if got > want || got < want-2*time.Second {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const paramLabelPrefix = model.ParamLabelPrefix
+
+// resolveTarget applies relabel_configs to a target's label set the way
+// Prometheus does: __address__, __scheme__, __metrics_path__ and __param_*
+// make up the scrape URL, instance defaults to the address, and labels
+// starting with "__" are removed afterwards. keep is false if a rule dropped
+// the target.
+// query holds the parameters of a static target's url. A __param_* label
+// only has room for one value, so it replaces the first value of its
+// parameter and any further values are kept.
+func resolveTarget(lbls labels.Labels, query url.Values, cfgs []*relabel.Config) (scrapeURL string, targetLabels labels.Labels, keep bool, err error) {
+	lbls, keep = relabel.Process(lbls, cfgs...)
+	if !keep {
+		return "", labels.EmptyLabels(), false, nil
+	}
+
+	address := lbls.Get(model.AddressLabel)
+	if address == "" {
+		return "", labels.EmptyLabels(), false, fmt.Errorf("no address after relabeling")
+	}
+
+	u := &url.URL{
+		Scheme: lbls.Get(model.SchemeLabel),
+		Host:   address,
+		Path:   lbls.Get(model.MetricsPathLabel),
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", labels.EmptyLabels(), false, fmt.Errorf("invalid scheme %q after relabeling", u.Scheme)
+	}
+
+	params := url.Values{}
+	b := labels.NewBuilder(labels.EmptyLabels())
+	lbls.Range(func(l labels.Label) {
+		if name, ok := strings.CutPrefix(l.Name, paramLabelPrefix); ok {
+			values := slices.Clone(query[name])
+			if len(values) > 0 {
+				values[0] = l.Value
+			} else {
+				values = []string{l.Value}
+			}
+			params[name] = values
+		}
+		if !strings.HasPrefix(l.Name, model.ReservedLabelPrefix) {
+			b.Set(l.Name, l.Value)
+		}
+	})
+	u.RawQuery = params.Encode()
+
+	if lbls.Get(model.InstanceLabel) == "" {
+		b.Set(model.InstanceLabel, address)
+	}
+
+	return u.String(), b.Labels(), true, nil
+}
+
+// initialTargetLabels builds the label set of a static target before
+// relabeling. A query parameter given more than once gets a label for its
+// first value.
+func initialTargetLabels(u *url.URL, job, instance string, extra map[string]string) labels.Labels {
+	b := labels.NewBuilder(labels.EmptyLabels())
+	for name, value := range extra {
+		b.Set(name, value)
+	}
+	for name, values := range u.Query() {
+		if len(values) > 0 {
+			b.Set(paramLabelPrefix+name, values[0])
+		}
+	}
+
+	b.Set(model.AddressLabel, u.Host)
+	b.Set(model.SchemeLabel, u.Scheme)
+	b.Set(model.MetricsPathLabel, u.Path)
+	b.Set(model.JobLabel, job)
+	if instance != "" {
+		b.Set(model.InstanceLabel, instance)
+	}
+
+	return b.Labels()
+}
+
+// relabelSeries applies metric_relabel_configs to every series, removing the
+// ones a rule drops
+func relabelSeries(series []bridgeSeries, cfgs []*relabel.Config) []bridgeSeries {
+	if len(cfgs) == 0 {
+		return series
+	}
+
+	kept := series[:0]
+	for _, s := range series {
+		lbls, keep := relabel.Process(toLabels(s.Labels), cfgs...)
+		if !keep || lbls.IsEmpty() {
+			continue
+		}
+
+		s.Labels = prompb.FromLabels(lbls, nil)
+		kept = append(kept, s)
+	}
+
+	return kept
+}
+
+// toLabels converts remote write labels to a sorted label set
+func toLabels(pl []prompb.Label) labels.Labels {
+	b := labels.NewScratchBuilder(len(pl))
+	for _, l := range pl {
+		b.Add(l.Name, l.Value)
+	}
+	b.Sort()
+	return b.Labels()
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"go.yaml.in/yaml/v2"
+)
+
+func parseRelabelConfigs(t *testing.T, config string) []*relabel.Config {
+	t.Helper()
+	var cfgs []*relabel.Config
+	if err := yaml.UnmarshalStrict([]byte(config), &cfgs); err != nil {
+		t.Fatal(err)
+	}
+	return cfgs
+}
+
+func TestResolveTarget(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		url        string
+		instance   string
+		relabel    string
+		wantURL    string
+		wantLabels map[string]string
+		wantDrop   bool
+		err        string
+	}{
+		{
+			name:       "static target",
+			url:        "http://app:8080/metrics",
+			wantURL:    "http://app:8080/metrics",
+			wantLabels: map[string]string{"job": "test", "instance": "app:8080", "env": "dev"},
+		},
+		{
+			name:       "explicit instance",
+			url:        "http://app:8080/metrics",
+			instance:   "app-1",
+			wantURL:    "http://app:8080/metrics",
+			wantLabels: map[string]string{"instance": "app-1"},
+		},
+		{
+			name:    "repeated query parameters are kept",
+			url:     "http://exporter:9115/probe?module=http&module=tcp&target=example.com",
+			wantURL: "http://exporter:9115/probe?module=http&module=tcp&target=example.com",
+		},
+		{
+			name: "param label replaces the first value",
+			url:  "http://exporter:9115/probe?module=http&module=tcp",
+			relabel: `
+- target_label: __param_module
+  replacement: icmp`,
+			wantURL: "http://exporter:9115/probe?module=icmp&module=tcp",
+		},
+		{
+			name: "dropped param label removes the parameter",
+			url:  "http://exporter:9115/probe?module=http&target=example.com",
+			relabel: `
+- regex: __param_target
+  action: labeldrop`,
+			wantURL: "http://exporter:9115/probe?module=http",
+		},
+		{
+			name: "blackbox style rewrite",
+			url:  "http://example.com:443/",
+			relabel: `
+- source_labels: [__address__]
+  target_label: __param_target
+- source_labels: [__param_target]
+  target_label: instance
+- target_label: __address__
+  replacement: exporter:9115
+- target_label: __metrics_path__
+  replacement: /probe`,
+			wantURL:    "http://exporter:9115/probe?target=example.com%3A443",
+			wantLabels: map[string]string{"instance": "example.com:443", model.AddressLabel: "", "__param_target": ""},
+		},
+		{
+			name: "scheme from relabeling",
+			url:  "http://app:8080/metrics",
+			relabel: `
+- target_label: __scheme__
+  replacement: https`,
+			wantURL: "https://app:8080/metrics",
+		},
+		{
+			name: "dropped",
+			url:  "http://app:8080/metrics",
+			relabel: `
+- source_labels: [env]
+  regex: dev
+  action: drop`,
+			wantDrop: true,
+		},
+		{
+			name: "no address",
+			url:  "http://app:8080/metrics",
+			relabel: `
+- regex: __address__
+  action: labeldrop`,
+			err: "no address after relabeling",
+		},
+		{
+			name: "invalid scheme",
+			url:  "http://app:8080/metrics",
+			relabel: `
+- target_label: __scheme__
+  replacement: ftp`,
+			err: `invalid scheme "ftp"`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := url.Parse(tc.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			initial := initialTargetLabels(u, "test", tc.instance, map[string]string{"env": "dev"})
+			scrapeURL, lbls, keep, err := resolveTarget(initial, u.Query(), parseRelabelConfigs(t, tc.relabel))
+
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got %v, want an error containing %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keep == tc.wantDrop {
+				t.Fatalf("got keep %v, want %v", keep, !tc.wantDrop)
+			}
+			if !keep {
+				return
+			}
+
+			if scrapeURL != tc.wantURL {
+				t.Errorf("got url %s, want %s", scrapeURL, tc.wantURL)
+			}
+			lbls.Range(func(l labels.Label) {
+				if strings.HasPrefix(l.Name, model.ReservedLabelPrefix) {
+					t.Errorf("reserved label %s kept", l.Name)
+				}
+			})
+			for name, value := range tc.wantLabels {
+				if got := lbls.Get(name); got != value {
+					t.Errorf("%s = %q, want %q", name, got, value)
+				}
+			}
+		})
+	}
+}
+
+func TestRelabelSeries(t *testing.T) {
+	cfgs := parseRelabelConfigs(t, `
+- source_labels: [__name__]
+  regex: debug_.*
+  action: drop
+- source_labels: [pod]
+  target_label: instance
+- regex: pod
+  action: labeldrop`)
+
+	keep := aggregationInput("requests_total", 1, "pod", "web-1")
+	keep.CreatedTimestamp = 500
+	series := []bridgeSeries{
+		keep,
+		aggregationInput("debug_requests_total", 1),
+		aggregationInput("other_total", 1),
+	}
+
+	got := relabelSeries(series, cfgs)
+	if len(got) != 2 {
+		t.Fatalf("got %d series, want the debug series dropped", len(got))
+	}
+	if labelValue(got[0].Labels, "instance") != "web-1" || labelValue(got[0].Labels, "pod") != "" {
+		t.Errorf("got labels %v, want pod moved to instance", got[0].Labels)
+	}
+	if got[0].CreatedTimestamp != 500 || got[0].Metadata.Type != keep.Metadata.Type || got[0].Samples[0].Value != 1 {
+		t.Errorf("got %+v, want samples, created timestamp and metadata kept", got[0])
+	}
+
+	// A series left without any label is dropped
+	if got := relabelSeries([]bridgeSeries{aggregationInput("a_total", 1)}, parseRelabelConfigs(t, "- regex: nothing\n  action: labelkeep")); len(got) != 0 {
+		t.Errorf("got %v, want the series without labels dropped", got)
+	}
+
+	if got := relabelSeries(series[:1], nil); len(got) != 1 {
+		t.Errorf("got %d series without rules, want 1", len(got))
+	}
+}
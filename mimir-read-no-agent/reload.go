@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	config_util "github.com/prometheus/common/config"
+)
+
+// bridge owns the scrape pool, the aggregator and the remote writer, and
+// applies config reloads and service discovery updates to them. Targets whose
+// config did not change keep running.
+type bridge struct {
+	configFile string
+	overrides  configOverrides
+
+	// mu serializes reloads and discovery updates
+	mu         sync.Mutex
+	cfg        *Config
+	writer     *fanoutWriter
+	aggregator *aggregator
+	pool       *scrapePool
+
+	// discovered holds the latest targets of each discoverer
+	discovered    map[string][]*TargetConfig
+	stopDiscovery context.CancelFunc
+}
+
+// newBridge loads the config, opens the WAL and starts scraping every target
+func newBridge(configFile string, overrides configOverrides) (*bridge, error) {
+	cfg, err := loadConfig(configFile, overrides)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	writer, err := newFanoutWriter(cfg.RemoteWrite, cfg.WAL)
+	if err != nil {
+		return nil, err
+	}
+
+	agg := newAggregator(writer)
+	b := &bridge{
+		configFile: configFile,
+		overrides:  overrides,
+		cfg:        cfg,
+		writer:     writer,
+		aggregator: agg,
+		pool:       newScrapePool(writer, agg),
+		discovered: make(map[string][]*TargetConfig),
+	}
+
+	b.mu.Lock()
+	b.aggregator.apply(cfg.StreamAggregation)
+	b.startDiscovery()
+	b.pool.sync(b.allTargets())
+	b.mu.Unlock()
+	setReloadSuccess(true)
+
+	return b, nil
+}
+
+// reload reads the config file again. An invalid config is rejected and the
+// bridge keeps running with the previous one.
+func (b *bridge) reload() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cfg, err := loadConfig(b.configFile, b.overrides)
+	if err != nil {
+		setReloadSuccess(false)
+		return err
+	}
+
+	if !reflect.DeepEqual(cfg.RemoteWrite, b.cfg.RemoteWrite) || !reflect.DeepEqual(cfg.WAL, b.cfg.WAL) {
+		if err := b.writer.reload(cfg.RemoteWrite, cfg.WAL); err != nil {
+			setReloadSuccess(false)
+			return err
+		}
+	}
+
+	b.cfg = cfg
+	b.aggregator.apply(cfg.StreamAggregation)
+	b.startDiscovery()
+	b.pool.sync(b.allTargets())
+	setReloadSuccess(true)
+
+	log.Printf("Reloaded config with %d targets\n", len(cfg.Targets))
+	return nil
+}
+
+// startDiscovery restarts the discoverers of the current config. Targets
+// found by the previous ones keep running until the new ones report, unless
+// their template was removed.
+func (b *bridge) startDiscovery() {
+	if b.stopDiscovery != nil {
+		b.stopDiscovery()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b.stopDiscovery = cancel
+
+	keys := make(map[string]bool)
+	for _, t := range b.cfg.Targets {
+		for name, d := range t.discoverers() {
+			key := t.Job + "/" + name
+			keys[key] = true
+			go b.runDiscovery(ctx, key, t, d)
+		}
+	}
+
+	for key := range b.discovered {
+		if !keys[key] {
+			delete(b.discovered, key)
+		}
+	}
+}
+
+// updateDiscovered replaces the targets of one discoverer. Updates from
+// discoverers stopped by a reload or shutdown are ignored.
+func (b *bridge) updateDiscovered(ctx context.Context, key string, targets []*TargetConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	b.discovered[key] = targets
+	b.pool.sync(b.allTargets())
+}
+
+// allTargets returns the static targets followed by the discovered ones
+func (b *bridge) allTargets() []*TargetConfig {
+	var targets []*TargetConfig
+	for _, t := range b.cfg.Targets {
+		if !t.hasDiscovery() {
+			targets = append(targets, t)
+		}
+	}
+
+	keys := make([]string, 0, len(b.discovered))
+	for key := range b.discovered {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		targets = append(targets, b.discovered[key]...)
+	}
+
+	return targets
+}
+
+// shutdown stops scraping, marks every target's series stale and sends what
+// is queued until ctx is done
+func (b *bridge) shutdown(ctx context.Context) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Once the deadline passes, aborts the sends still retrying so the feeders
+	// and shards exit and drain returns; what was not sent stays in the WAL
+	stop := context.AfterFunc(ctx, b.writer.abort)
+	defer stop()
+
+	if b.stopDiscovery != nil {
+		b.stopDiscovery()
+	}
+	b.pool.sync(nil)
+	b.aggregator.apply(nil)
+	b.writer.drain(ctx)
+}
+
+// handleReload serves /-/reload like Prometheus: POST or PUT reloads the config
+func (b *bridge) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := b.reload(); err != nil {
+		log.Printf("Error reloading config: %v\n", err)
+		http.Error(w, fmt.Sprintf("failed to reload config: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// newPushClient builds the HTTP client for remote write from its auth and TLS settings
+func newPushClient(rw RemoteWriteConfig) (*http.Client, error) {
+	client, err := config_util.NewClientFromConfig(rw.HTTPClientConfig, "remote_write")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create remote write client: %w", err)
+	}
+	client.Timeout = time.Duration(rw.RemoteTimeout)
+	return client, nil
+}
+
+func setReloadSuccess(ok bool) {
+	if !ok {
+		configLastReloadSuccessful.Set(0)
+		return
+	}
+	configLastReloadSuccessful.Set(1)
+	configLastReloadSuccessTimestamp.SetToCurrentTime()
+}
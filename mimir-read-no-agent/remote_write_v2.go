@@ -0,0 +1,234 @@
+package main
+
+import (
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	remoteWriteProtoMsgV1 = "prometheus.WriteRequest"
+	remoteWriteProtoMsgV2 = "io.prometheus.write.v2.Request"
+)
+
+// walFamilyNameField is the field of writev2.Metadata WAL records keep the
+// symbol ref of the metric family name in. Remote write 2.0 has no field for
+// it, but 1.0 metadata is sent per family. Requests sent to receivers do not
+// carry it.
+const walFamilyNameField protowire.Number = 100
+
+// toV2Request encodes a batch as a remote write 2.0 request. Label names and
+// values, help text and units are interned once in the request's symbol table.
+func toV2Request(batch []bridgeSeries) *writev2.Request {
+	symbols := writev2.NewSymbolTable()
+	req := &writev2.Request{Timeseries: make([]writev2.TimeSeries, 0, len(batch))}
+
+	for _, s := range batch {
+		ts := writev2.TimeSeries{
+			LabelsRefs:       symbolizeLabels(&symbols, s.Labels),
+			CreatedTimestamp: s.CreatedTimestamp,
+			Metadata: writev2.Metadata{
+				// The v1 and v2 metric type enums share their values
+				Type:    writev2.Metadata_MetricType(s.Metadata.Type),
+				HelpRef: symbols.Symbolize(s.Metadata.Help),
+				UnitRef: symbols.Symbolize(s.Metadata.Unit),
+			},
+		}
+
+		for _, sample := range s.Samples {
+			ts.Samples = append(ts.Samples, writev2.Sample{Value: sample.Value, Timestamp: sample.Timestamp})
+		}
+		for _, h := range s.Histograms {
+			ts.Histograms = append(ts.Histograms, histogramToV2(h))
+		}
+		for _, e := range s.Exemplars {
+			ts.Exemplars = append(ts.Exemplars, writev2.Exemplar{
+				LabelsRefs: symbolizeLabels(&symbols, e.Labels),
+				Value:      e.Value,
+				Timestamp:  e.Timestamp,
+			})
+		}
+
+		req.Timeseries = append(req.Timeseries, ts)
+	}
+
+	req.Symbols = symbols.Symbols()
+	return req
+}
+
+// toWALRequest encodes a batch as a remote write 2.0 request that also keeps
+// the metric family name of every series
+func toWALRequest(batch []bridgeSeries) *writev2.Request {
+	req := toV2Request(batch)
+
+	refs := make(map[string]uint32, len(req.Symbols))
+	for i, s := range req.Symbols {
+		refs[s] = uint32(i)
+	}
+	for i, s := range batch {
+		name := s.Metadata.MetricFamilyName
+		if name == "" {
+			continue
+		}
+		ref, ok := refs[name]
+		if !ok {
+			ref = uint32(len(req.Symbols))
+			req.Symbols = append(req.Symbols, name)
+			refs[name] = ref
+		}
+
+		md := &req.Timeseries[i].Metadata
+		md.XXX_unrecognized = protowire.AppendTag(md.XXX_unrecognized, walFamilyNameField, protowire.VarintType)
+		md.XXX_unrecognized = protowire.AppendVarint(md.XXX_unrecognized, uint64(ref))
+	}
+
+	return req
+}
+
+// walFamilyName returns the metric family name toWALRequest kept in the
+// metadata, or "" for a request without one
+func walFamilyName(symbols []string, md writev2.Metadata) string {
+	b := md.XXX_unrecognized
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return ""
+		}
+		b = b[n:]
+
+		if num == walFamilyNameField && typ == protowire.VarintType {
+			ref, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return ""
+			}
+			return symbol(symbols, uint32(ref))
+		}
+
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return ""
+		}
+		b = b[n:]
+	}
+	return ""
+}
+
+// fromV2Request decodes a remote write 2.0 request back into bridge series,
+// with the metric family names of a request written by toWALRequest
+func fromV2Request(req *writev2.Request) []bridgeSeries {
+	batch := make([]bridgeSeries, 0, len(req.Timeseries))
+
+	for _, ts := range req.Timeseries {
+		s := bridgeSeries{
+			TimeSeries:       prompb.TimeSeries{Labels: desymbolizeLabels(req.Symbols, ts.LabelsRefs)},
+			CreatedTimestamp: ts.CreatedTimestamp,
+			Metadata: prompb.MetricMetadata{
+				Type:             prompb.MetricMetadata_MetricType(ts.Metadata.Type),
+				MetricFamilyName: walFamilyName(req.Symbols, ts.Metadata),
+				Help:             symbol(req.Symbols, ts.Metadata.HelpRef),
+				Unit:             symbol(req.Symbols, ts.Metadata.UnitRef),
+			},
+		}
+
+		for _, sample := range ts.Samples {
+			s.Samples = append(s.Samples, prompb.Sample{Value: sample.Value, Timestamp: sample.Timestamp})
+		}
+		for _, h := range ts.Histograms {
+			s.Histograms = append(s.Histograms, histogramFromV2(h))
+		}
+		for _, e := range ts.Exemplars {
+			s.Exemplars = append(s.Exemplars, prompb.Exemplar{
+				Labels:    desymbolizeLabels(req.Symbols, e.LabelsRefs),
+				Value:     e.Value,
+				Timestamp: e.Timestamp,
+			})
+		}
+
+		batch = append(batch, s)
+	}
+
+	return batch
+}
+
+func symbolizeLabels(symbols *writev2.SymbolsTable, labels []prompb.Label) []uint32 {
+	refs := make([]uint32, 0, 2*len(labels))
+	for _, l := range labels {
+		refs = append(refs, symbols.Symbolize(l.Name), symbols.Symbolize(l.Value))
+	}
+	return refs
+}
+
+func desymbolizeLabels(symbols []string, refs []uint32) []prompb.Label {
+	labels := make([]prompb.Label, 0, len(refs)/2)
+	for i := 0; i+1 < len(refs); i += 2 {
+		labels = append(labels, prompb.Label{Name: symbol(symbols, refs[i]), Value: symbol(symbols, refs[i+1])})
+	}
+	return labels
+}
+
+func symbol(symbols []string, ref uint32) string {
+	if int(ref) >= len(symbols) {
+		return ""
+	}
+	return symbols[ref]
+}
+
+func histogramToV2(h prompb.Histogram) writev2.Histogram {
+	v2 := writev2.Histogram{
+		Sum:            h.Sum,
+		Schema:         h.Schema,
+		ZeroThreshold:  h.ZeroThreshold,
+		NegativeDeltas: h.NegativeDeltas,
+		NegativeCounts: h.NegativeCounts,
+		PositiveDeltas: h.PositiveDeltas,
+		PositiveCounts: h.PositiveCounts,
+		ResetHint:      writev2.Histogram_ResetHint(h.ResetHint),
+		Timestamp:      h.Timestamp,
+	}
+	for _, span := range h.NegativeSpans {
+		v2.NegativeSpans = append(v2.NegativeSpans, writev2.BucketSpan{Offset: span.Offset, Length: span.Length})
+	}
+	for _, span := range h.PositiveSpans {
+		v2.PositiveSpans = append(v2.PositiveSpans, writev2.BucketSpan{Offset: span.Offset, Length: span.Length})
+	}
+
+	if h.IsFloatHistogram() {
+		v2.Count = &writev2.Histogram_CountFloat{CountFloat: h.GetCountFloat()}
+		v2.ZeroCount = &writev2.Histogram_ZeroCountFloat{ZeroCountFloat: h.GetZeroCountFloat()}
+	} else {
+		v2.Count = &writev2.Histogram_CountInt{CountInt: h.GetCountInt()}
+		v2.ZeroCount = &writev2.Histogram_ZeroCountInt{ZeroCountInt: h.GetZeroCountInt()}
+	}
+
+	return v2
+}
+
+func histogramFromV2(v2 writev2.Histogram) prompb.Histogram {
+	h := prompb.Histogram{
+		Sum:            v2.Sum,
+		Schema:         v2.Schema,
+		ZeroThreshold:  v2.ZeroThreshold,
+		NegativeDeltas: v2.NegativeDeltas,
+		NegativeCounts: v2.NegativeCounts,
+		PositiveDeltas: v2.PositiveDeltas,
+		PositiveCounts: v2.PositiveCounts,
+		ResetHint:      prompb.Histogram_ResetHint(v2.ResetHint),
+		Timestamp:      v2.Timestamp,
+	}
+	for _, span := range v2.NegativeSpans {
+		h.NegativeSpans = append(h.NegativeSpans, prompb.BucketSpan{Offset: span.Offset, Length: span.Length})
+	}
+	for _, span := range v2.PositiveSpans {
+		h.PositiveSpans = append(h.PositiveSpans, prompb.BucketSpan{Offset: span.Offset, Length: span.Length})
+	}
+
+	if v2.IsFloatHistogram() {
+		h.Count = &prompb.Histogram_CountFloat{CountFloat: v2.GetCountFloat()}
+		h.ZeroCount = &prompb.Histogram_ZeroCountFloat{ZeroCountFloat: v2.GetZeroCountFloat()}
+	} else {
+		h.Count = &prompb.Histogram_CountInt{CountInt: v2.GetCountInt()}
+		h.ZeroCount = &prompb.Histogram_ZeroCountInt{ZeroCountInt: v2.GetZeroCountInt()}
+	}
+
+	return h
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+)
+
+func testV2Batch() []bridgeSeries {
+	counter := testSeries("requests_total", 1000, 5)
+	counter.Labels = append(counter.Labels, prompb.Label{Name: "job", Value: "test"})
+	counter.Metadata = prompb.MetricMetadata{Type: prompb.MetricMetadata_COUNTER, MetricFamilyName: "requests", Help: "Requests served.", Unit: "requests"}
+	counter.Exemplars = []prompb.Exemplar{{Labels: []prompb.Label{{Name: "trace_id", Value: "abc"}}, Value: 1, Timestamp: 900}}
+
+	native := bridgeSeries{
+		TimeSeries: prompb.TimeSeries{
+			Labels: []prompb.Label{{Name: "__name__", Value: "latency_seconds"}},
+			Histograms: []prompb.Histogram{{
+				Count:          &prompb.Histogram_CountInt{CountInt: 3},
+				ZeroCount:      &prompb.Histogram_ZeroCountInt{ZeroCountInt: 1},
+				Sum:            2.5,
+				Schema:         3,
+				ZeroThreshold:  0.001,
+				PositiveSpans:  []prompb.BucketSpan{{Offset: -1, Length: 2}},
+				PositiveDeltas: []int64{1, 0},
+				NegativeSpans:  []prompb.BucketSpan{{Offset: 0, Length: 1}},
+				NegativeDeltas: []int64{0},
+				ResetHint:      prompb.Histogram_UNKNOWN,
+				Timestamp:      1000,
+			}},
+		},
+		CreatedTimestamp: 500,
+		Metadata:         prompb.MetricMetadata{Type: prompb.MetricMetadata_HISTOGRAM, MetricFamilyName: "latency_seconds", Unit: "seconds"},
+	}
+
+	float := native
+	float.Labels = []prompb.Label{{Name: "__name__", Value: "queue_size"}}
+	float.Histograms = []prompb.Histogram{{
+		Count:          &prompb.Histogram_CountFloat{CountFloat: 2.5},
+		ZeroCount:      &prompb.Histogram_ZeroCountFloat{ZeroCountFloat: 0.5},
+		Sum:            17,
+		PositiveSpans:  []prompb.BucketSpan{{Offset: 0, Length: 1}},
+		PositiveCounts: []float64{2},
+		ResetHint:      prompb.Histogram_GAUGE,
+		Timestamp:      1000,
+	}}
+	float.CreatedTimestamp = 0
+	float.Metadata = prompb.MetricMetadata{Type: prompb.MetricMetadata_GAUGEHISTOGRAM, MetricFamilyName: "queue_size"}
+
+	return []bridgeSeries{counter, native, float}
+}
+
+func TestWALRequestRoundTrip(t *testing.T) {
+	want := testV2Batch()
+
+	data, err := proto.Marshal(toWALRequest(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req writev2.Request
+	if err := proto.Unmarshal(data, &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Symbols[0] != "" {
+		t.Errorf("got first symbol %q, want the empty string", req.Symbols[0])
+	}
+
+	got := fromV2Request(&req)
+	if len(got) != len(want) {
+		t.Fatalf("got %d series, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("series %d:\ngot  %+v\nwant %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestV2RequestWithoutFamilyName(t *testing.T) {
+	batch := testV2Batch()
+
+	// Receivers get a plain remote write 2.0 request
+	req := toV2Request(batch)
+	for i, ts := range req.Timeseries {
+		if ts.Metadata.XXX_unrecognized != nil {
+			t.Errorf("series %d: got extra metadata fields %v", i, ts.Metadata.XXX_unrecognized)
+		}
+	}
+
+	got := fromV2Request(req)
+	for i := range got {
+		if got[i].Metadata.MetricFamilyName != "" || got[i].Metadata.Help != batch[i].Metadata.Help || got[i].Metadata.Type != batch[i].Metadata.Type {
+			t.Errorf("series %d: got metadata %+v", i, got[i].Metadata)
+		}
+	}
+}
+
+// versionedReceiver accepts remote write 1.0 and rejects 2.0 with 415, like
+// a receiver that predates 2.0
+type versionedReceiver struct {
+	*httptest.Server
+
+	mu           sync.Mutex
+	contentTypes []string
+	series       []prompb.TimeSeries
+}
+
+func newVersionedReceiver(t *testing.T) *versionedReceiver {
+	r := &versionedReceiver{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		contentType := req.Header.Get("Content-Type")
+		r.contentTypes = append(r.contentTypes, contentType)
+		if strings.Contains(contentType, remoteWriteProtoMsgV2) {
+			http.Error(w, "unsupported", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		body, _ := io.ReadAll(req.Body)
+		data, err := snappy.Decode(nil, body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var wr prompb.WriteRequest
+		if err := proto.Unmarshal(data, &wr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.series = append(r.series, wr.Timeseries...)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func TestPushUnsupportedV2(t *testing.T) {
+	recv := newVersionedReceiver(t)
+
+	_, err := pushToMimir(t.Context(), http.DefaultClient, recv.URL, "", testV2Batch(), remoteWriteProtoMsgV2)
+	if err != errProtoMsgUnsupported {
+		t.Errorf("got %v, want errProtoMsgUnsupported", err)
+	}
+	if _, err := pushToMimir(t.Context(), http.DefaultClient, recv.URL, "", testV2Batch(), remoteWriteProtoMsgV1); err != nil {
+		t.Errorf("got %v for remote write 1.0", err)
+	}
+}
+
+func TestQueueFallsBackToV1(t *testing.T) {
+	recv := newVersionedReceiver(t)
+	rw := testRemoteWriteConfig(recv.URL)
+	rw.ProtobufMessage = remoteWriteProtoMsgV2
+	q := newTestQueue(t, rw, t.TempDir())
+
+	if err := q.enqueue(testV2Batch()); err != nil {
+		t.Fatal(err)
+	}
+	drainQueue(t, q)
+
+	recv.mu.Lock()
+	defer recv.mu.Unlock()
+	if len(recv.series) != 3 {
+		t.Errorf("got %d series, want all 3 sent with remote write 1.0", len(recv.series))
+	}
+	if len(recv.contentTypes) < 2 || !strings.Contains(recv.contentTypes[0], remoteWriteProtoMsgV2) || recv.contentTypes[len(recv.contentTypes)-1] != "application/x-protobuf" {
+		t.Errorf("got content types %v, want 2.0 first and 1.0 after the 415", recv.contentTypes)
+	}
+	if got := q.protoMsg.Load().(string); got != remoteWriteProtoMsgV1 {
+		t.Errorf("got protobuf message %s after the fallback, want %s", got, remoteWriteProtoMsgV1)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// scrapeReport holds the outcome of one scrape, reported with the same
+// synthetic series Prometheus and Alloy add to every target
+type scrapeReport struct {
+	up                 bool
+	duration           time.Duration
+	samplesScraped     int
+	samplesPostRelabel int
+	seriesAdded        int
+}
+
+// reportMetric describes one synthetic series
+type reportMetric struct {
+	name string
+	help string
+}
+
+var (
+	upMetric                 = reportMetric{"up", "Health of the scrape target. 1 = healthy, 0 = unhealthy."}
+	scrapeDurationMetric     = reportMetric{"scrape_duration_seconds", "Duration of the scrape."}
+	samplesScrapedMetric     = reportMetric{"scrape_samples_scraped", "The number of samples the target exposed."}
+	samplesPostRelabelMetric = reportMetric{"scrape_samples_post_metric_relabeling", "The number of samples remaining after metric relabeling was applied."}
+	seriesAddedMetric        = reportMetric{"scrape_series_added", "The approximate number of new series in this scrape."}
+)
+
+// series returns the synthetic series of the scrape, labeled with the target labels
+func (r scrapeReport) series(targetLabels []prompb.Label, timestamp int64) []bridgeSeries {
+	up := 0.0
+	if r.up {
+		up = 1
+	}
+
+	return []bridgeSeries{
+		r.sample(upMetric, up, targetLabels, timestamp),
+		r.sample(scrapeDurationMetric, r.duration.Seconds(), targetLabels, timestamp),
+		r.sample(samplesScrapedMetric, float64(r.samplesScraped), targetLabels, timestamp),
+		r.sample(samplesPostRelabelMetric, float64(r.samplesPostRelabel), targetLabels, timestamp),
+		r.sample(seriesAddedMetric, float64(r.seriesAdded), targetLabels, timestamp),
+	}
+}
+
+func (r scrapeReport) sample(m reportMetric, value float64, targetLabels []prompb.Label, timestamp int64) bridgeSeries {
+	return bridgeSeries{
+		TimeSeries: prompb.TimeSeries{
+			Labels:  newLabelBuilder(nil, targetLabels).labels(m.name),
+			Samples: []prompb.Sample{{Value: value, Timestamp: timestamp}},
+		},
+		Metadata: prompb.MetricMetadata{
+			Type:             prompb.MetricMetadata_GAUGE,
+			MetricFamilyName: m.name,
+			Help:             m.help,
+		},
+	}
+}
+
+// reportStaleMarkers ends the synthetic series of a target that was removed
+func reportStaleMarkers(targetLabels []prompb.Label, timestamp int64) []bridgeSeries {
+	var markers []bridgeSeries
+	for _, s := range (scrapeReport{}).series(targetLabels, timestamp) {
+		markers = append(markers, staleMarker(s, timestamp))
+	}
+	return markers
+}
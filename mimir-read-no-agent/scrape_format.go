@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Scrape protocols use the same names as Prometheus' scrape_protocols setting
+const (
+	scrapeProtocolPrometheusProto      = "PrometheusProto"
+	scrapeProtocolPrometheusText0_0_4  = "PrometheusText0.0.4"
+	scrapeProtocolOpenMetricsText0_0_1 = "OpenMetricsText0.0.1"
+	scrapeProtocolOpenMetricsText1_0_0 = "OpenMetricsText1.0.0"
+)
+
+var scrapeProtocolHeaders = map[string]string{
+	scrapeProtocolPrometheusProto:      "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited",
+	scrapeProtocolPrometheusText0_0_4:  "text/plain;version=0.0.4",
+	scrapeProtocolOpenMetricsText0_0_1: "application/openmetrics-text;version=0.0.1",
+	scrapeProtocolOpenMetricsText1_0_0: "application/openmetrics-text;version=1.0.0",
+}
+
+// defaultScrapeProtocols prefers protobuf, the only format that carries
+// native histograms, then OpenMetrics for exemplars and created timestamps
+var defaultScrapeProtocols = []string{
+	scrapeProtocolPrometheusProto,
+	scrapeProtocolOpenMetricsText1_0_0,
+	scrapeProtocolOpenMetricsText0_0_1,
+	scrapeProtocolPrometheusText0_0_4,
+}
+
+// acceptHeader builds an Accept header that asks for the protocols in order
+// of preference, falling back to anything the target can serve
+func acceptHeader(protocols []string) string {
+	var parts []string
+	weight := len(protocols) + 1
+	for _, p := range protocols {
+		parts = append(parts, fmt.Sprintf("%s;q=0.%d", scrapeProtocolHeaders[p], weight))
+		weight--
+	}
+	parts = append(parts, fmt.Sprintf("*/*;q=0.%d", weight))
+	return strings.Join(parts, ",")
+}
+
+// decodeScrape decodes a scrape response body according to its Content-Type.
+// Targets that send no or an unknown Content-Type are treated as Prometheus text.
+func decodeScrape(body []byte, contentType string) (map[string]*io_prometheus_client.MetricFamily, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = ""
+	}
+
+	switch {
+	case mediaType == expfmt.ProtoType && params["proto"] == expfmt.ProtoProtocol && params["encoding"] == "delimited":
+		return decodeExpfmt(body, expfmt.NewFormat(expfmt.TypeProtoDelim))
+	case mediaType == expfmt.OpenMetricsType:
+		return parseOpenMetrics(body)
+	default:
+		return decodeExpfmt(body, expfmt.NewFormat(expfmt.TypeTextPlain))
+	}
+}
+
+func decodeExpfmt(body []byte, format expfmt.Format) (map[string]*io_prometheus_client.MetricFamily, error) {
+	decoder := expfmt.NewDecoder(bytes.NewReader(body), format)
+
+	metrics := make(map[string]*io_prometheus_client.MetricFamily)
+
+	for {
+		mf := &io_prometheus_client.MetricFamily{}
+		err := decoder.Decode(mf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode: %w", err)
+		}
+
+		metrics[mf.GetName()] = mf
+	}
+
+	return metrics, nil
+}
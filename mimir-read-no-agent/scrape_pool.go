@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"time"
+)
+
+// scrapePool runs a scrape loop per target on its own goroutine, so a slow
+// target does not delay the others
+type scrapePool struct {
+	writer     *fanoutWriter
+	aggregator *aggregator
+	// seed spreads the scrape offsets of bridges on different hosts that
+	// scrape the same targets
+	seed  uint64
+	loops map[string]*scrapeLoop
+}
+
+// scrapeLoop scrapes a single target at a fixed offset within its interval
+type scrapeLoop struct {
+	cfg    *TargetConfig
+	state  *targetState
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// targetState is what a target carries from one scrape to the next. It is
+// kept when a config change restarts the target's scrape loop.
+type targetState struct {
+	stale       *staleTracker
+	exemplars   *exemplarTracker
+	validator   *seriesValidator
+	temporality *temporalityConverter
+}
+
+func newTargetState() *targetState {
+	return &targetState{
+		stale:       newStaleTracker(),
+		exemplars:   newExemplarTracker(),
+		validator:   newSeriesValidator(),
+		temporality: newTemporalityConverter(),
+	}
+}
+
+func newScrapePool(writer *fanoutWriter, agg *aggregator) *scrapePool {
+	h := fnv.New64a()
+	hostname, _ := os.Hostname()
+	h.Write([]byte(hostname))
+
+	return &scrapePool{
+		writer:     writer,
+		aggregator: agg,
+		seed:       h.Sum64(),
+		loops:      make(map[string]*scrapeLoop),
+	}
+}
+
+// sync starts new targets, restarts changed ones and stops the ones no
+// longer configured, marking all of their series stale
+func (p *scrapePool) sync(targets []*TargetConfig) {
+	next := make(map[string]*scrapeLoop, len(targets))
+	for _, t := range targets {
+		key := t.String()
+		if _, ok := next[key]; ok {
+			log.Printf("[%s] Skipping duplicate target %s\n", key, t.scrapeURL)
+			continue
+		}
+
+		sl, ok := p.loops[key]
+		if !ok {
+			next[key] = p.start(t, newTargetState())
+			continue
+		}
+		delete(p.loops, key)
+
+		if reflect.DeepEqual(sl.cfg, t) {
+			next[key] = sl
+			continue
+		}
+
+		// Keep the series of the last scrape so the ones the new config no
+		// longer produces are marked stale
+		sl.stop()
+		next[key] = p.start(t, sl.state)
+	}
+
+	for _, sl := range p.loops {
+		sl.stop()
+
+		scrapeTime := time.Now().UnixMilli()
+		markers := append(sl.state.stale.markAll(scrapeTime), reportStaleMarkers(sl.cfg.targetLabels(), scrapeTime)...)
+		log.Printf("[%s] Stopped scraping, marking %d series stale\n", sl.cfg, len(markers))
+		if err := p.writer.write(markers, sl.cfg.Tenant); err != nil {
+			log.Printf("[%s] Error writing to WAL: %v\n", sl.cfg, err)
+		}
+	}
+
+	p.loops = next
+}
+
+func (p *scrapePool) start(t *TargetConfig, state *targetState) *scrapeLoop {
+	interval := time.Duration(t.Interval)
+	offset := p.offset(t, interval, time.Now())
+	log.Printf("Scraping %s from: %s every %v, first scrape in %v\n", t, t.scrapeURL, t.Interval, offset.Round(time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sl := &scrapeLoop{
+		cfg:    t,
+		state:  state,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(sl.done)
+		sl.run(ctx, p.writer, p.aggregator, offset)
+	}()
+
+	return sl
+}
+
+// offset returns how long to wait before a target's first scrape. Like in
+// Prometheus, every target gets a fixed slot within its interval derived
+// from its identity, so scrapes are spread out instead of bunching up, and
+// a target keeps its slot across restarts and reloads.
+func (p *scrapePool) offset(t *TargetConfig, interval time.Duration, now time.Time) time.Duration {
+	h := fnv.New64a()
+	h.Write([]byte(t.String()))
+	h.Write([]byte{0})
+	h.Write([]byte(t.scrapeURL))
+	slot := (h.Sum64() ^ p.seed) % uint64(interval)
+
+	// Time until the start of the next interval, counted from the Unix epoch
+	base := uint64(interval) - uint64(now.UnixNano())%uint64(interval)
+	return time.Duration((slot + base) % uint64(interval))
+}
+
+// run scrapes the target after offset, then on every tick of its interval
+// until ctx is cancelled. A scrape that overruns its interval makes the loop
+// skip the ticks it missed rather than scrape in a burst to catch up.
+func (sl *scrapeLoop) run(ctx context.Context, writer *fanoutWriter, agg *aggregator, offset time.Duration) {
+	// The timeout is enforced per scrape through its context
+	scrapeClient := &http.Client{}
+	interval := time.Duration(sl.cfg.Interval)
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(offset):
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		start := time.Now()
+		scrapeAndPush(ctx, scrapeClient, writer, agg, sl.cfg, sl.state)
+
+		if elapsed := time.Since(start); elapsed > interval && ctx.Err() == nil {
+			skipped := int(elapsed / interval)
+			log.Printf("[%s] Scrape took %v, longer than its %v interval, skipping %d ticks\n", sl.cfg, elapsed.Round(time.Millisecond), sl.cfg.Interval, skipped)
+			scrapeTicksSkippedTotal.WithLabelValues(sl.cfg.Job, sl.cfg.Instance).Add(float64(skipped))
+
+			// Drop the tick the ticker kept while the scrape was running,
+			// so the next scrape happens in the target's slot
+			select {
+			case <-ticker.C:
+			default:
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// stop ends the target's goroutine after its current scrape
+func (sl *scrapeLoop) stop() {
+	sl.cancel()
+	<-sl.done
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestScrapePoolOffset(t *testing.T) {
+	interval := 15 * time.Second
+	p := &scrapePool{seed: 1}
+	web := &TargetConfig{Job: "web", Instance: "web-1:8080", scrapeURL: "http://web-1:8080/metrics"}
+
+	// Wherever a start falls, the scrapes land in the same slot of the interval
+	start := time.UnixMilli(1_700_000_000_123)
+	slot := start.Add(p.offset(web, interval, start)).UnixNano() % int64(interval)
+	for _, d := range []time.Duration{0, time.Millisecond, 7 * time.Second, interval - 1, interval, 3*interval + 11*time.Millisecond} {
+		now := start.Add(d)
+		offset := p.offset(web, interval, now)
+		if offset < 0 || offset >= interval {
+			t.Fatalf("got offset %v at +%v, want one within the %v interval", offset, d, interval)
+		}
+		if offset != p.offset(web, interval, now) {
+			t.Errorf("offset at +%v is not stable", d)
+		}
+		if got := now.Add(offset).UnixNano() % int64(interval); got != slot {
+			t.Errorf("first scrape at +%v lands in slot %v, want %v", d, time.Duration(got), time.Duration(slot))
+		}
+	}
+
+	// Other targets, and the same target on another host, get other slots
+	slotOf := func(p *scrapePool, t *TargetConfig) time.Duration {
+		return p.offset(t, interval, time.Unix(0, 0))
+	}
+	others := map[string]time.Duration{
+		"instance": slotOf(p, &TargetConfig{Job: "web", Instance: "web-2:8080", scrapeURL: "http://web-2:8080/metrics"}),
+		"url":      slotOf(p, &TargetConfig{Job: "web", Instance: "web-1:8080", scrapeURL: "http://web-1:8080/other"}),
+		"seed":     slotOf(&scrapePool{seed: 2}, web),
+	}
+	for name, other := range others {
+		if other == slotOf(p, web) {
+			t.Errorf("a different %s got the same slot %v", name, other)
+		}
+	}
+}
+
+// lastUp returns the last up sample a receiver got for a job
+func lastUp(recv *testReceiver, job string) (prompb.Sample, bool) {
+	var last prompb.Sample
+	found := false
+	for _, s := range recv.received() {
+		if labelValue(s.Labels, model.MetricNameLabel) == "up" && labelValue(s.Labels, "job") == job {
+			last, found = s.Samples[len(s.Samples)-1], true
+		}
+	}
+	return last, found
+}
+
+func TestScrapePoolSync(t *testing.T) {
+	a := newTestTarget(t, "a_total 1\n")
+	b := newTestTarget(t, "b_total 1\n")
+	recv := newTestReceiver(t)
+	rw := testRemoteWriteConfig(recv.URL)
+	writer := newTestWriter(t, &rw)
+
+	loadTargets := func(bLabels string) []*TargetConfig {
+		t.Helper()
+		cfg, err := loadTestConfig(t, fmt.Sprintf(`
+targets:
+  - url: %s/metrics
+    job: a
+    interval: 20ms
+  - url: %s/metrics
+    job: b
+    interval: 20ms
+    labels: {%s}
+`, a.URL, b.URL, bLabels), configOverrides{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg.Targets
+	}
+
+	p := newScrapePool(writer, newAggregator(writer))
+	defer p.sync(nil)
+
+	targets := loadTargets("")
+	// A target listed twice is scraped once
+	p.sync(append(targets, targets[0]))
+	if len(p.loops) != 2 {
+		t.Fatalf("got %d scrape loops, want 2", len(p.loops))
+	}
+	waitFor(t, "both targets to be scraped", func() bool {
+		_, okA := lastUp(recv, "a")
+		_, okB := lastUp(recv, "b")
+		return okA && okB
+	})
+
+	// An unchanged target keeps its loop, a changed one is restarted with
+	// the state of its previous loop
+	keyA, keyB := targets[0].String(), targets[1].String()
+	loopA, loopB := p.loops[keyA], p.loops[keyB]
+	p.sync(loadTargets("team: x"))
+	if p.loops[keyA] != loopA {
+		t.Error("unchanged target was restarted")
+	}
+	if p.loops[keyB] == loopB || p.loops[keyB].state != loopB.state {
+		t.Error("changed target was not restarted with its previous state")
+	}
+	select {
+	case <-loopB.done:
+	default:
+		t.Error("loop of the changed target is still running")
+	}
+
+	// A removed target is stopped and its series and up are marked stale
+	p.sync(loadTargets("team: x")[:1])
+	if len(p.loops) != 1 || p.loops[keyA] != loopA {
+		t.Fatalf("got loops %v, want only a's", p.loops)
+	}
+	waitFor(t, "stale markers of the removed target", func() bool {
+		up, _ := lastUp(recv, "b")
+		return value.IsStaleNaN(up.Value)
+	})
+	if !value.IsStaleNaN(lastValues(recv)["b_total"].Value) {
+		t.Error("series of the removed target were not marked stale")
+	}
+	if up, _ := lastUp(recv, "a"); value.IsStaleNaN(up.Value) {
+		t.Error("target a was marked stale")
+	}
+}
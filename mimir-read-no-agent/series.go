@@ -0,0 +1,53 @@
+package main
+
+import (
+	"github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// bridgeSeries is a converted series plus the per-series fields remote write
+// 1.0 has no room for. Remote write 2.0 sends them inline with the series.
+type bridgeSeries struct {
+	prompb.TimeSeries
+
+	// CreatedTimestamp is when a counter, summary or histogram started counting, 0 if unknown
+	CreatedTimestamp int64
+	Metadata         prompb.MetricMetadata
+}
+
+// familyMetadata returns the TYPE, HELP and UNIT of a scraped metric family.
+// name is the family name as exposed, which for OpenMetrics counters lacks
+// the _total suffix of their samples.
+func familyMetadata(name string, mf *io_prometheus_client.MetricFamily) prompb.MetricMetadata {
+	metadata := prompb.MetricMetadata{
+		MetricFamilyName: name,
+		Help:             mf.GetHelp(),
+		Unit:             mf.GetUnit(),
+	}
+
+	switch mf.GetType() {
+	case io_prometheus_client.MetricType_COUNTER:
+		metadata.Type = prompb.MetricMetadata_COUNTER
+	case io_prometheus_client.MetricType_GAUGE:
+		metadata.Type = prompb.MetricMetadata_GAUGE
+	case io_prometheus_client.MetricType_SUMMARY:
+		metadata.Type = prompb.MetricMetadata_SUMMARY
+	case io_prometheus_client.MetricType_HISTOGRAM:
+		metadata.Type = prompb.MetricMetadata_HISTOGRAM
+	case io_prometheus_client.MetricType_GAUGE_HISTOGRAM:
+		metadata.Type = prompb.MetricMetadata_GAUGEHISTOGRAM
+	default:
+		metadata.Type = prompb.MetricMetadata_UNKNOWN
+	}
+
+	return metadata
+}
+
+// v1Timeseries strips the bridge-only fields for a remote write 1.0 request
+func v1Timeseries(batch []bridgeSeries) []prompb.TimeSeries {
+	timeseries := make([]prompb.TimeSeries, len(batch))
+	for i, s := range batch {
+		timeseries[i] = s.TimeSeries
+	}
+	return timeseries
+}
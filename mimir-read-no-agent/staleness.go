@@ -0,0 +1,83 @@
+package main
+
+import (
+	"math"
+
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// staleTracker remembers the series of a target's last scrape. Series that
+// disappear, or all of them when the target goes down, get a Prometheus stale
+// marker so queries stop returning them right away instead of after the 5
+// minute lookback.
+type staleTracker struct {
+	prev map[uint64]bridgeSeries
+}
+
+func newStaleTracker() *staleTracker {
+	return &staleTracker{prev: make(map[uint64]bridgeSeries)}
+}
+
+// update records the series of a successful scrape and returns stale markers
+// for the series of the previous scrape that are missing from it, along with
+// the number of series that are new. Like Prometheus, series with a timestamp
+// exposed by the target are not tracked.
+func (t *staleTracker) update(series []bridgeSeries, scrapeTime int64) ([]bridgeSeries, int) {
+	cur := make(map[uint64]bridgeSeries, len(series))
+	added := 0
+	for _, s := range series {
+		if seriesTimestamp(s) != scrapeTime {
+			continue
+		}
+		hash := toLabels(s.Labels).Hash()
+		if _, ok := t.prev[hash]; !ok {
+			added++
+		}
+		cur[hash] = s
+	}
+
+	var markers []bridgeSeries
+	for hash, s := range t.prev {
+		if _, ok := cur[hash]; !ok {
+			markers = append(markers, staleMarker(s, scrapeTime))
+		}
+	}
+
+	t.prev = cur
+	return markers, added
+}
+
+// markAll returns stale markers for every series of the previous scrape and forgets them
+func (t *staleTracker) markAll(scrapeTime int64) []bridgeSeries {
+	markers := make([]bridgeSeries, 0, len(t.prev))
+	for _, s := range t.prev {
+		markers = append(markers, staleMarker(s, scrapeTime))
+	}
+
+	t.prev = make(map[uint64]bridgeSeries)
+	return markers
+}
+
+// staleMarker returns a stale NaN sample for the series. Mimir turns it into
+// a histogram stale marker if the series holds native histograms.
+func staleMarker(s bridgeSeries, timestamp int64) bridgeSeries {
+	return bridgeSeries{
+		TimeSeries: prompb.TimeSeries{
+			Labels:  s.Labels,
+			Samples: []prompb.Sample{{Value: math.Float64frombits(value.StaleNaN), Timestamp: timestamp}},
+		},
+		Metadata: s.Metadata,
+	}
+}
+
+// seriesTimestamp returns the timestamp of the series' sample or histogram
+func seriesTimestamp(s bridgeSeries) int64 {
+	if len(s.Samples) > 0 {
+		return s.Samples[0].Timestamp
+	}
+	if len(s.Histograms) > 0 {
+		return s.Histograms[0].Timestamp
+	}
+	return 0
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestStaleTrackerUpdate(t *testing.T) {
+	tracker := newStaleTracker()
+
+	markers, added := tracker.update([]bridgeSeries{testSeries("a_total", 1000, 1), testSeries("b_total", 1000, 1)}, 1000)
+	if len(markers) != 0 || added != 2 {
+		t.Fatalf("first scrape: got %d markers and %d added, want 0 and 2", len(markers), added)
+	}
+
+	// b disappears and c is new
+	markers, added = tracker.update([]bridgeSeries{testSeries("a_total", 2000, 2), testSeries("c_total", 2000, 1)}, 2000)
+	if added != 1 {
+		t.Errorf("got %d added, want 1", added)
+	}
+	if len(markers) != 1 {
+		t.Fatalf("got %d markers, want 1", len(markers))
+	}
+	m := markers[0]
+	if labelValue(m.Labels, "__name__") != "b_total" || m.Samples[0].Timestamp != 2000 || !value.IsStaleNaN(m.Samples[0].Value) {
+		t.Errorf("got marker %v %v, want a stale NaN for b_total at 2000", m.Labels, m.Samples)
+	}
+	if m.Metadata.Type != prompb.MetricMetadata_COUNTER {
+		t.Errorf("got marker metadata %+v, want the series' metadata", m.Metadata)
+	}
+
+	// The same series again gives no markers
+	if markers, added := tracker.update([]bridgeSeries{testSeries("a_total", 3000, 3), testSeries("c_total", 3000, 1)}, 3000); len(markers) != 0 || added != 0 {
+		t.Errorf("got %d markers and %d added for an unchanged scrape", len(markers), added)
+	}
+}
+
+func TestStaleTrackerExposedTimestamps(t *testing.T) {
+	tracker := newStaleTracker()
+
+	// A series with a timestamp of its own is not tracked, like Prometheus does
+	_, added := tracker.update([]bridgeSeries{testSeries("a_total", 1000, 1), testSeries("exposed_total", 500, 1)}, 1000)
+	if added != 1 {
+		t.Errorf("got %d added, want only the series stamped with the scrape time", added)
+	}
+
+	markers, _ := tracker.update(nil, 2000)
+	if len(markers) != 1 || labelValue(markers[0].Labels, "__name__") != "a_total" {
+		t.Errorf("got markers %v, want one for a_total only", markers)
+	}
+}
+
+func TestStaleTrackerNativeHistogram(t *testing.T) {
+	tracker := newStaleTracker()
+
+	h := bridgeSeries{
+		TimeSeries: prompb.TimeSeries{
+			Labels:     []prompb.Label{{Name: "__name__", Value: "latency_seconds"}},
+			Histograms: []prompb.Histogram{{Sum: 1, Count: &prompb.Histogram_CountInt{CountInt: 1}, Timestamp: 1000}},
+		},
+		Metadata: prompb.MetricMetadata{Type: prompb.MetricMetadata_HISTOGRAM},
+	}
+	if _, added := tracker.update([]bridgeSeries{h}, 1000); added != 1 {
+		t.Fatalf("got %d added, want the histogram series tracked", added)
+	}
+
+	markers, _ := tracker.update(nil, 2000)
+	if len(markers) != 1 {
+		t.Fatalf("got %d markers, want 1", len(markers))
+	}
+	// Mimir turns a float stale marker on a histogram series into a histogram one
+	m := markers[0]
+	if len(m.Histograms) != 0 || len(m.Samples) != 1 || !value.IsStaleNaN(m.Samples[0].Value) || m.Samples[0].Timestamp != 2000 {
+		t.Errorf("got marker %+v, want a float stale NaN at 2000", m.TimeSeries)
+	}
+	if m.Metadata.Type != prompb.MetricMetadata_HISTOGRAM {
+		t.Errorf("got marker type %v, want HISTOGRAM", m.Metadata.Type)
+	}
+}
+
+func TestStaleTrackerMarkAll(t *testing.T) {
+	tracker := newStaleTracker()
+	tracker.update([]bridgeSeries{testSeries("a_total", 1000, 1), testSeries("b_total", 1000, 1)}, 1000)
+
+	markers := tracker.markAll(2000)
+	if len(markers) != 2 {
+		t.Fatalf("got %d markers, want 2", len(markers))
+	}
+	for _, m := range markers {
+		if !value.IsStaleNaN(m.Samples[0].Value) || m.Samples[0].Timestamp != 2000 {
+			t.Errorf("got marker %v, want a stale NaN at 2000", m.Samples)
+		}
+	}
+
+	// After a failed scrape the series are forgotten and count as new again
+	if markers := tracker.markAll(3000); len(markers) != 0 {
+		t.Errorf("got %d markers from a second markAll, want 0", len(markers))
+	}
+	if _, added := tracker.update([]bridgeSeries{testSeries("a_total", 4000, 1)}, 4000); added != 1 {
+		t.Errorf("got %d added after markAll, want 1", added)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// convertSummary turns a scraped summary into <name>{quantile="..."},
+// <name>_sum and <name>_count series, the same shape Alloy pushes
+func convertSummary(name string, b *labelBuilder, s *io_prometheus_client.Summary, timestamp int64) []prompb.TimeSeries {
+	timeseries := make([]prompb.TimeSeries, 0, len(s.GetQuantile())+2)
+
+	for _, q := range s.GetQuantile() {
+		timeseries = append(timeseries, prompb.TimeSeries{
+			Labels: b.labels(name, prompb.Label{
+				Name:  model.QuantileLabel,
+				Value: formatFloat(q.GetQuantile()),
+			}),
+			Samples: []prompb.Sample{{Value: q.GetValue(), Timestamp: timestamp}},
+		})
+	}
+
+	timeseries = append(timeseries,
+		prompb.TimeSeries{
+			Labels:  b.labels(name + "_sum"),
+			Samples: []prompb.Sample{{Value: s.GetSampleSum(), Timestamp: timestamp}},
+		},
+		prompb.TimeSeries{
+			Labels:  b.labels(name + "_count"),
+			Samples: []prompb.Sample{{Value: float64(s.GetSampleCount()), Timestamp: timestamp}},
+		},
+	)
+
+	return timeseries
+}
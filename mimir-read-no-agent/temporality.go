@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	temporalityDeltaToCumulative = "delta_to_cumulative"
+	temporalityCumulativeToDelta = "cumulative_to_delta"
+
+	defaultTemporalityMaxStale = 10 * time.Minute
+)
+
+// TemporalityRule converts the samples of matching series between delta
+// (the increase since the last scrape) and cumulative (the total since the
+// counter started) temporality
+type TemporalityRule struct {
+	// Metrics is a regex matched against the metric name, anchored like relabeling
+	Metrics string `yaml:"metrics"`
+	Mode    string `yaml:"mode"`
+	// MaxStale forgets a series that has not been scraped for this long. A
+	// delta series that comes back starts a new cumulative counter.
+	MaxStale model.Duration `yaml:"max_stale,omitempty"`
+
+	re *regexp.Regexp
+}
+
+func (r *TemporalityRule) validate() error {
+	if r.Metrics == "" {
+		return fmt.Errorf("metrics is required")
+	}
+	re, err := regexp.Compile("^(?:" + r.Metrics + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid metrics regex %q: %w", r.Metrics, err)
+	}
+	r.re = re
+
+	if r.Mode != temporalityDeltaToCumulative && r.Mode != temporalityCumulativeToDelta {
+		return fmt.Errorf("mode must be %q or %q", temporalityDeltaToCumulative, temporalityCumulativeToDelta)
+	}
+
+	if r.MaxStale == 0 {
+		r.MaxStale = model.Duration(defaultTemporalityMaxStale)
+	}
+	if r.MaxStale < 0 {
+		return fmt.Errorf("max_stale must be positive")
+	}
+
+	return nil
+}
+
+// temporalityState is what is known about one converted series
+type temporalityState struct {
+	mode string
+	// value is the running total for delta_to_cumulative and the last
+	// scraped total for cumulative_to_delta
+	value     float64
+	created   int64
+	timestamp int64
+	lastSeen  time.Time
+}
+
+// temporalityConverter applies a target's temporality rules, keeping the
+// state of every converted series between scrapes
+type temporalityConverter struct {
+	series map[uint64]*temporalityState
+}
+
+func newTemporalityConverter() *temporalityConverter {
+	return &temporalityConverter{series: make(map[uint64]*temporalityState)}
+}
+
+// convert rewrites the float samples of series matched by a rule, the first
+// matching rule winning. Native histograms, summary quantiles and stale
+// markers are passed through. The first sample of a cumulative_to_delta
+// series only sets its baseline and is dropped, as are negative or NaN
+// deltas, which restart the total. State not updated within the rule's
+// max_stale is forgotten.
+func (c *temporalityConverter) convert(series []bridgeSeries, rules []*TemporalityRule, now time.Time) []bridgeSeries {
+	if len(rules) == 0 {
+		return series
+	}
+
+	kept := series[:0]
+	for _, s := range series {
+		rule := matchTemporalityRule(s, rules)
+		if rule == nil || len(s.Samples) != 1 || value.IsStaleNaN(s.Samples[0].Value) {
+			kept = append(kept, s)
+			continue
+		}
+
+		hash := toLabels(s.Labels).Hash()
+		st, ok := c.series[hash]
+		if ok && (st.mode != rule.Mode || now.Sub(st.lastSeen) > time.Duration(rule.MaxStale)) {
+			ok = false
+		}
+
+		sample := &s.Samples[0]
+		switch rule.Mode {
+		case temporalityDeltaToCumulative:
+			if !ok {
+				st = &temporalityState{mode: rule.Mode, created: sample.Timestamp}
+				c.series[hash] = st
+			}
+			st.timestamp, st.lastSeen = sample.Timestamp, now
+
+			if sample.Value < 0 || math.IsNaN(sample.Value) {
+				delete(c.series, hash)
+				continue
+			}
+			st.value += sample.Value
+			sample.Value = st.value
+			s.CreatedTimestamp = st.created
+			if s.Metadata.Type == prompb.MetricMetadata_GAUGE || s.Metadata.Type == prompb.MetricMetadata_UNKNOWN {
+				s.Metadata.Type = prompb.MetricMetadata_COUNTER
+			}
+
+		case temporalityCumulativeToDelta:
+			total := sample.Value
+			if !ok {
+				c.series[hash] = &temporalityState{mode: rule.Mode, value: total, timestamp: sample.Timestamp, lastSeen: now}
+				continue
+			}
+
+			// A total below the last one means the counter restarted from zero
+			delta := total - st.value
+			if delta < 0 {
+				delta = total
+			}
+			st.value, st.timestamp, st.lastSeen = total, sample.Timestamp, now
+
+			sample.Value = delta
+			s.CreatedTimestamp = 0
+			s.Metadata.Type = prompb.MetricMetadata_GAUGE
+		}
+
+		kept = append(kept, s)
+	}
+
+	c.expire(rules, now)
+	return kept
+}
+
+// expire forgets series not seen within the max_stale of their mode's rules
+func (c *temporalityConverter) expire(rules []*TemporalityRule, now time.Time) {
+	maxStale := make(map[string]time.Duration)
+	for _, r := range rules {
+		if d := time.Duration(r.MaxStale); d > maxStale[r.Mode] {
+			maxStale[r.Mode] = d
+		}
+	}
+
+	for hash, st := range c.series {
+		if now.Sub(st.lastSeen) > maxStale[st.mode] {
+			delete(c.series, hash)
+		}
+	}
+}
+
+func matchTemporalityRule(s bridgeSeries, rules []*TemporalityRule) *TemporalityRule {
+	var name string
+	for _, l := range s.Labels {
+		switch l.Name {
+		case model.MetricNameLabel:
+			name = l.Value
+		case model.QuantileLabel:
+			return nil
+		}
+	}
+
+	for _, r := range rules {
+		if r.re.MatchString(name) {
+			return r
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestTemporalityConvert(t *testing.T) {
+	// step is one scrape of a single series: a nil want means the sample is dropped
+	type step struct {
+		at    time.Duration
+		value float64
+		want  *float64
+	}
+	v := func(f float64) *float64 { return &f }
+	stale := math.Float64frombits(value.StaleNaN)
+
+	for _, tc := range []struct {
+		name  string
+		mode  string
+		steps []step
+	}{
+		{"delta sums", temporalityDeltaToCumulative, []step{
+			{0, 2, v(2)}, {time.Minute, 3, v(5)}, {2 * time.Minute, 0, v(5)},
+		}},
+		{"negative delta restarts", temporalityDeltaToCumulative, []step{
+			{0, 2, v(2)}, {time.Minute, -1, nil}, {2 * time.Minute, 3, v(3)},
+		}},
+		{"NaN delta restarts", temporalityDeltaToCumulative, []step{
+			{0, 2, v(2)}, {time.Minute, math.NaN(), nil}, {2 * time.Minute, 3, v(3)},
+		}},
+		{"delta gap past max_stale restarts", temporalityDeltaToCumulative, []step{
+			{0, 2, v(2)}, {time.Minute, 3, v(5)}, {10 * time.Minute, 4, v(9)}, {30 * time.Minute, 1, v(1)},
+		}},
+		{"delta stale marker passes", temporalityDeltaToCumulative, []step{
+			{0, 2, v(2)}, {time.Minute, stale, v(stale)}, {2 * time.Minute, 1, v(3)},
+		}},
+		{"cumulative first sample is the baseline", temporalityCumulativeToDelta, []step{
+			{0, 10, nil}, {time.Minute, 15, v(5)}, {2 * time.Minute, 15, v(0)},
+		}},
+		{"cumulative reset", temporalityCumulativeToDelta, []step{
+			{0, 10, nil}, {time.Minute, 4, v(4)}, {2 * time.Minute, 6, v(2)},
+		}},
+		{"cumulative gap past max_stale sets a new baseline", temporalityCumulativeToDelta, []step{
+			{0, 10, nil}, {time.Minute, 12, v(2)}, {30 * time.Minute, 20, nil}, {31 * time.Minute, 21, v(1)},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rule := &TemporalityRule{Metrics: "requests.*", Mode: tc.mode}
+			if err := rule.validate(); err != nil {
+				t.Fatal(err)
+			}
+			c := newTemporalityConverter()
+			start := time.UnixMilli(1_000_000)
+
+			for i, st := range tc.steps {
+				now := start.Add(st.at)
+				s := testSeries("requests", now.UnixMilli(), st.value)
+				s.Metadata.Type = prompb.MetricMetadata_UNKNOWN
+				got := c.convert([]bridgeSeries{s}, []*TemporalityRule{rule}, now)
+
+				if st.want == nil {
+					if len(got) != 0 {
+						t.Errorf("step %d: got %v, want the sample dropped", i, got[0].Samples)
+					}
+					continue
+				}
+				if len(got) != 1 {
+					t.Fatalf("step %d: got %d series, want 1", i, len(got))
+				}
+				gotValue := got[0].Samples[0].Value
+				if value.IsStaleNaN(*st.want) {
+					if !value.IsStaleNaN(gotValue) {
+						t.Errorf("step %d: got %v, want a stale marker", i, gotValue)
+					}
+					continue
+				}
+				if gotValue != *st.want {
+					t.Errorf("step %d: got %v, want %v", i, gotValue, *st.want)
+				}
+
+				wantType := prompb.MetricMetadata_COUNTER
+				if tc.mode == temporalityCumulativeToDelta {
+					wantType = prompb.MetricMetadata_GAUGE
+					if got[0].CreatedTimestamp != 0 {
+						t.Errorf("step %d: got created timestamp %d on a delta", i, got[0].CreatedTimestamp)
+					}
+				}
+				if got[0].Metadata.Type != wantType {
+					t.Errorf("step %d: got type %v, want %v", i, got[0].Metadata.Type, wantType)
+				}
+			}
+		})
+	}
+}
+
+func TestTemporalityCreatedTimestamp(t *testing.T) {
+	rule := &TemporalityRule{Metrics: "requests", Mode: temporalityDeltaToCumulative}
+	if err := rule.validate(); err != nil {
+		t.Fatal(err)
+	}
+	c := newTemporalityConverter()
+	start := time.UnixMilli(1_000_000)
+
+	for i, at := range []time.Duration{0, time.Minute} {
+		now := start.Add(at)
+		got := c.convert([]bridgeSeries{testSeries("requests", now.UnixMilli(), 1)}, []*TemporalityRule{rule}, now)
+		if got[0].CreatedTimestamp != start.UnixMilli() {
+			t.Errorf("scrape %d: got created timestamp %d, want the first sample's %d", i, got[0].CreatedTimestamp, start.UnixMilli())
+		}
+	}
+}
+
+func TestTemporalityPassThrough(t *testing.T) {
+	rule := &TemporalityRule{Metrics: "rpc_seconds|requests", Mode: temporalityCumulativeToDelta, MaxStale: model.Duration(time.Minute)}
+	if err := rule.validate(); err != nil {
+		t.Fatal(err)
+	}
+	c := newTemporalityConverter()
+
+	quantile := testSeries("rpc_seconds", 1, 0.5)
+	quantile.Labels = append(quantile.Labels, prompb.Label{Name: model.QuantileLabel, Value: "0.9"})
+	other := testSeries("other", 1, 7)
+
+	got := c.convert([]bridgeSeries{quantile, other}, []*TemporalityRule{rule}, time.Now())
+	if len(got) != 2 || got[0].Samples[0].Value != 0.5 || got[1].Samples[0].Value != 7 {
+		t.Errorf("got %v, want summary quantiles and unmatched series untouched", got)
+	}
+	if len(c.series) != 0 {
+		t.Errorf("got %d tracked series, want 0", len(c.series))
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// TenantRule derives the Mimir tenant of a series from its labels. The
+// source label values are joined with separator and matched against regex;
+// on a match the tenant is replacement with $1 style capture groups expanded.
+type TenantRule struct {
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    string   `yaml:"separator,omitempty"`
+	Regex        string   `yaml:"regex,omitempty"`
+	Replacement  string   `yaml:"replacement,omitempty"`
+
+	re *regexp.Regexp
+}
+
+func (r *TenantRule) validate() error {
+	if len(r.SourceLabels) == 0 {
+		return fmt.Errorf("source_labels is required")
+	}
+	if r.Separator == "" {
+		r.Separator = ";"
+	}
+	if r.Regex == "" {
+		r.Regex = "(.+)"
+	}
+	if r.Replacement == "" {
+		r.Replacement = "$1"
+	}
+
+	// Anchored like Prometheus relabeling
+	re, err := regexp.Compile("^(?:" + r.Regex + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid regex %q: %w", r.Regex, err)
+	}
+	r.re = re
+
+	return nil
+}
+
+// tenant returns the tenant the rule derives from labels, or "" if it does not match
+func (r *TenantRule) tenant(labels []prompb.Label) string {
+	values := make([]string, len(r.SourceLabels))
+	for i, name := range r.SourceLabels {
+		values[i] = labelValue(labels, name)
+	}
+
+	value := strings.Join(values, r.Separator)
+	match := r.re.FindStringSubmatchIndex(value)
+	if match == nil {
+		return ""
+	}
+
+	return string(r.re.ExpandString(nil, r.Replacement, value, match))
+}
+
+// dropInvalidTenant is the reason of bridge_remote_write_series_dropped_total
+// for series whose tenant rule gives an invalid tenant ID
+const dropInvalidTenant = "invalid_tenant"
+
+// validateTenantID applies Mimir's tenant ID rules. The name of the
+// directory holding the WAL of further endpoints is reserved as well.
+func validateTenantID(tenant string) error {
+	if len(tenant) > 150 {
+		return fmt.Errorf("tenant %q is longer than 150 characters", tenant)
+	}
+	if tenant == "." || tenant == ".." || tenant == endpointsWALDir {
+		return fmt.Errorf("tenant %q is not allowed", tenant)
+	}
+	for _, r := range tenant {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("!-_.*'()", r):
+		default:
+			return fmt.Errorf("tenant %q contains unsupported character %q", tenant, r)
+		}
+	}
+	return nil
+}
+
+// remoteWriter routes series to a queue per tenant. Every tenant has its own
+// WAL directory and shards, so one tenant being rate limited does not hold
+// back the others.
+type remoteWriter struct {
+	// writeMu is held by writes and taken exclusively to swap the queues on
+	// reload, so client, rw and walCfg never change during a write
+	writeMu sync.RWMutex
+
+	mu     sync.Mutex
+	client *http.Client
+	rw     RemoteWriteConfig
+	walCfg WALConfig
+	queues map[string]*queueManager
+}
+
+// newRemoteWriter starts a queue for every tenant with records left in the WAL
+func newRemoteWriter(client *http.Client, rw RemoteWriteConfig, walCfg WALConfig) (*remoteWriter, error) {
+	w := &remoteWriter{
+		client: client,
+		rw:     rw,
+		walCfg: walCfg,
+		queues: make(map[string]*queueManager),
+	}
+
+	if err := w.start(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// start opens the queue of the default tenant and of every tenant with a WAL directory
+func (w *remoteWriter) start() error {
+	if _, err := w.queue(w.rw.Tenant); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(w.walCfg.Directory)
+	if err != nil {
+		return fmt.Errorf("failed to list wal dir: %w", err)
+	}
+	for _, e := range entries {
+		if !e.IsDir() || validateTenantID(e.Name()) != nil {
+			continue
+		}
+		if _, err := w.queue(e.Name()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reload replaces the queues with ones using the new settings. Samples the
+// old queues had not sent are still in the WAL and are replayed by the new
+// ones, so nothing in flight is lost; a batch that was partly acknowledged
+// may be sent twice, which Mimir accepts.
+func (w *remoteWriter) reload(client *http.Client, rw RemoteWriteConfig, walCfg WALConfig) error {
+	// Abort sends first so the old queues do not wait out their retries
+	w.abort()
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	w.mu.Lock()
+	for _, q := range w.queues {
+		q.stop()
+	}
+	w.client = client
+	w.rw = rw
+	w.walCfg = walCfg
+	w.queues = make(map[string]*queueManager)
+	w.mu.Unlock()
+
+	return w.start()
+}
+
+// stop closes every queue, leaving unsent samples in the WAL
+func (w *remoteWriter) stop() {
+	w.abort()
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, q := range w.queues {
+		q.stop()
+	}
+	w.queues = make(map[string]*queueManager)
+}
+
+// abort makes every queue give up sending, leaving unsent samples in the WAL
+func (w *remoteWriter) abort() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, q := range w.queues {
+		q.abort()
+	}
+}
+
+// drain sends what every queue holds until ctx is done. Samples left over
+// stay in the WAL and are sent on the next start.
+func (w *remoteWriter) drain(ctx context.Context) {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, q := range w.queues {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.drain(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+// write applies write_relabel_configs, then splits the series by tenant and
+// enqueues one write request per tenant
+func (w *remoteWriter) write(timeseries []bridgeSeries, targetTenant string) error {
+	w.writeMu.RLock()
+	defer w.writeMu.RUnlock()
+
+	// The series are shared with the other endpoints
+	if len(w.rw.WriteRelabelConfigs) > 0 {
+		timeseries = relabelSeries(slices.Clone(timeseries), w.rw.WriteRelabelConfigs)
+	}
+
+	byTenant := make(map[string][]bridgeSeries)
+	invalid := 0
+	for _, s := range timeseries {
+		tenant, ok := w.tenantFor(s.Labels, targetTenant)
+		if !ok {
+			invalid++
+			continue
+		}
+		byTenant[tenant] = append(byTenant[tenant], s)
+	}
+	if invalid > 0 {
+		log.Printf("Dropping %d series whose tenant_rules give an invalid tenant for %s\n", invalid, w.rw.URL)
+		remoteWriteSeriesDroppedTotal.WithLabelValues(w.rw.Name, w.rw.URL, dropInvalidTenant).Add(float64(invalid))
+	}
+
+	for tenant, series := range byTenant {
+		q, err := w.queue(tenant)
+		if err != nil {
+			return err
+		}
+		if err := q.enqueue(series); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// tenantFor picks the tenant of a series: the first matching tenant rule,
+// then the target's tenant, then the remote_write default. It returns false
+// if the matching rule gives an invalid tenant ID, rather than sending the
+// series to another tenant.
+func (w *remoteWriter) tenantFor(labels []prompb.Label, targetTenant string) (string, bool) {
+	for _, rule := range w.rw.TenantRules {
+		tenant := rule.tenant(labels)
+		if tenant == "" {
+			continue
+		}
+		return tenant, validateTenantID(tenant) == nil
+	}
+
+	if targetTenant != "" {
+		return targetTenant, true
+	}
+	return w.rw.Tenant, true
+}
+
+// queue returns the queue for a tenant, opening its WAL on first use.
+// Series without a tenant use the WAL directory itself.
+func (w *remoteWriter) queue(tenant string) (*queueManager, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if q, ok := w.queues[tenant]; ok {
+		return q, nil
+	}
+
+	walCfg := w.walCfg
+	if tenant != "" {
+		walCfg.Directory = filepath.Join(walCfg.Directory, tenant)
+	}
+
+	q, err := newQueueManager(w.client, w.rw, walCfg, tenant)
+	if err != nil {
+		return nil, err
+	}
+	go q.run()
+	if q.metadata != nil {
+		go q.runMetadata()
+	}
+
+	if tenant != "" {
+		log.Printf("Started remote write queue for tenant %s\n", tenant)
+	}
+	w.queues[tenant] = q
+
+	return q, nil
+}
+
+func labelValue(labels []prompb.Label, name string) string {
+	for _, l := range labels {
+		if l.Name == name {
+			return l.Value
+		}
+	}
+	return ""
+}
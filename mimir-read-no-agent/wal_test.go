@@ -0,0 +1,154 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func testSeries(name string, timestamp int64, value float64) bridgeSeries {
+	return bridgeSeries{
+		TimeSeries: prompb.TimeSeries{
+			Labels:  []prompb.Label{{Name: "__name__", Value: name}},
+			Samples: []prompb.Sample{{Value: value, Timestamp: timestamp}},
+		},
+		CreatedTimestamp: 1000,
+		Metadata:         prompb.MetricMetadata{Type: prompb.MetricMetadata_COUNTER, Help: "help"},
+	}
+}
+
+func TestWALAppendRead(t *testing.T) {
+	w, err := openWAL(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []bridgeSeries{testSeries("a_total", 1, 1), testSeries("b_total", 2, 2)}
+	seq, err := w.append(toWALRequest(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := w.read(seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := fromV2Request(req)
+	if len(got) != len(want) {
+		t.Fatalf("got %d series, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i].Labels, want[i].Labels) || !reflect.DeepEqual(got[i].Samples, want[i].Samples) {
+			t.Errorf("series %d: got %v %v, want %v %v", i, got[i].Labels, got[i].Samples, want[i].Labels, want[i].Samples)
+		}
+		if got[i].CreatedTimestamp != want[i].CreatedTimestamp || got[i].Metadata.Type != want[i].Metadata.Type || got[i].Metadata.Help != want[i].Metadata.Help {
+			t.Errorf("series %d: created timestamp or metadata not kept: %+v", i, got[i])
+		}
+	}
+}
+
+func TestWALReopen(t *testing.T) {
+	dir := t.TempDir()
+	w, err := openWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 3 {
+		if _, err := w.append(toWALRequest([]bridgeSeries{testSeries("a_total", int64(i), 1)})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.remove(2); err != nil {
+		t.Fatal(err)
+	}
+
+	// A record interrupted before its rename is cleaned up
+	if err := os.WriteFile(w.path(4)+".tmp", []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = openWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seqs, err := w.pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(seqs, []uint64{1, 3}) {
+		t.Errorf("got pending %v, want [1 3]", seqs)
+	}
+	if _, err := os.Stat(w.path(4) + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file was not removed: %v", err)
+	}
+
+	seq, err := w.append(toWALRequest([]bridgeSeries{testSeries("a_total", 4, 1)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != 4 {
+		t.Errorf("got seq %d after reopening, want 4", seq)
+	}
+}
+
+func TestWALCorruptRecord(t *testing.T) {
+	w, err := openWAL(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, err := w.append(toWALRequest([]bridgeSeries{testSeries("a_total", 1, 1)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := os.ReadFile(w.path(seq))
+	if err != nil {
+		t.Fatal(err)
+	}
+	record[len(record)-1] ^= 0xff
+	if err := os.WriteFile(w.path(seq), record, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.read(seq); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("got %v, want a checksum mismatch", err)
+	}
+
+	if err := os.WriteFile(w.path(seq), record[:3], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.read(seq); err == nil || !strings.Contains(err.Error(), "truncated") {
+		t.Errorf("got %v, want a truncated record", err)
+	}
+}
+
+func TestWALSize(t *testing.T) {
+	dir := t.TempDir()
+	w, err := openWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, err := w.append(toWALRequest([]bridgeSeries{testSeries("a_total", 1, 1)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "other"), []byte("not a record"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(w.path(seq))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := w.size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != info.Size() {
+		t.Errorf("got size %d, want %d", size, info.Size())
+	}
+}